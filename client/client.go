@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"rate-limiter/limiter"
+)
+
+const defaultTimeout = 500 * time.Millisecond
+
+type Options struct {
+	// Timeout bounds each call to the decision service. Defaults to 500ms.
+	Timeout time.Duration
+	// HTTPClient is used for the calls; http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// Fallback, when set, decides locally whenever the service cannot be
+	// reached, times out or answers with a 5xx. Its rules should match the
+	// service's.
+	Fallback *limiter.RateLimiter
+}
+
+// Client calls the decision service's POST /v1/check.
+type Client struct {
+	url        string
+	timeout    time.Duration
+	httpClient *http.Client
+	fallback   *limiter.RateLimiter
+}
+
+type checkRequest struct {
+	Key  string `json:"key"`
+	Cost int    `json:"cost"`
+	Rule string `json:"rule"`
+}
+
+func New(baseURL string, opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+
+	return &Client{
+		url:        strings.TrimRight(baseURL, "/") + "/v1/check",
+		timeout:    opts.Timeout,
+		httpClient: opts.HTTPClient,
+		fallback:   opts.Fallback,
+	}
+}
+
+// Check counts a request that costs cost units for key under the named rule.
+// A cost of zero or less counts as 1, as in the service.
+func (c *Client) Check(ctx context.Context, rule string, key string, cost int) (*limiter.Decision, error) {
+	if cost <= 0 {
+		cost = 1
+	}
+	decision, unavailable, err := c.check(ctx, rule, key, cost)
+	if !unavailable || c.fallback == nil {
+		return decision, err
+	}
+
+	localRule, exists := c.fallback.Rule(rule)
+	if !exists {
+		return nil, err
+	}
+	return c.fallback.AllowN(ctx, localRule, key, cost)
+}
+
+// check calls the service. unavailable reports errors that a local decision
+// may replace, as opposed to rejected requests.
+func (c *Client) check(ctx context.Context, rule string, key string, cost int) (decision *limiter.Decision, unavailable bool, err error) {
+	body, err := json.Marshal(checkRequest{Key: key, Cost: cost, Rule: rule})
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to call decision service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, fmt.Errorf("decision service returned status %d", resp.StatusCode)
+	}
+
+	decision = &limiter.Decision{}
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return nil, true, fmt.Errorf("failed to decode decision: %v", err)
+	}
+	return decision, false, nil
+}
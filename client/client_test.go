@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/limiter"
+	"rate-limiter/server"
+	"rate-limiter/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRateLimiter() *limiter.RateLimiter {
+	config := &limiter.Config{
+		Rules: map[string]limiter.Rule{
+			"search": {Name: "search", Limit: 2, BlockDuration: 60},
+		},
+	}
+	return limiter.NewRateLimiter(storage.NewMockStorage(), config)
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	server.RegisterRoutes(router, newTestRateLimiter())
+
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient_Check(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.URL, Options{})
+	ctx := context.Background()
+
+	decision, err := c.Check(ctx, "search", "user-1", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decision.Limited || decision.Remaining != 1 {
+		t.Errorf("Unexpected decision: %+v", decision)
+	}
+
+	decision, _ = c.Check(ctx, "search", "user-1", 2)
+	if !decision.Limited {
+		t.Error("Request over the limit should be limited")
+	}
+}
+
+func TestClient_BadRequest(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.URL, Options{Fallback: newTestRateLimiter()})
+
+	// Rejected requests are not retried locally.
+	if _, err := c.Check(context.Background(), "missing", "user-1", 1); err == nil {
+		t.Error("Expected error for unknown rule")
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := New(srv.URL, Options{Timeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := c.Check(context.Background(), "search", "user-1", 1); err == nil {
+		t.Error("Expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Timeout not applied, took %v", elapsed)
+	}
+}
+
+func TestClient_Fallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, Options{Fallback: newTestRateLimiter()})
+	ctx := context.Background()
+
+	decision, err := c.Check(ctx, "search", "user-1", 2)
+	if err != nil {
+		t.Fatalf("Expected local decision, got %v", err)
+	}
+	if decision.Limited || decision.Remaining != 0 {
+		t.Errorf("Unexpected decision: %+v", decision)
+	}
+
+	decision, _ = c.Check(ctx, "search", "user-1", 1)
+	if !decision.Limited {
+		t.Error("Local fallback should enforce the limit")
+	}
+
+	// Unreachable service.
+	c = New("http://127.0.0.1:1", Options{Fallback: newTestRateLimiter()})
+	if _, err := c.Check(ctx, "search", "user-1", 1); err != nil {
+		t.Errorf("Expected local decision, got %v", err)
+	}
+
+	// A zero cost counts as 1, locally as in the service.
+	decision, err = c.Check(ctx, "search", "user-1", 0)
+	if err != nil {
+		t.Fatalf("Expected local decision for a zero cost, got %v", err)
+	}
+	if decision.Limited || decision.Remaining != 0 {
+		t.Errorf("Unexpected decision for a zero cost: %+v", decision)
+	}
+}
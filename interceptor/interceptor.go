@@ -0,0 +1,134 @@
+package interceptor
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"rate-limiter/limiter"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// DefaultTokenMetadata is the metadata key read by ByAPIKey when none is
+// given, matching the API_KEY header of the HTTP middleware.
+const DefaultTokenMetadata = "api_key"
+
+// Limit checks one call. fullMethod is the gRPC method, e.g.
+// "/package.Service/Method".
+type Limit func(ctx context.Context, rateLimiter *limiter.RateLimiter, fullMethod string) (*limiter.Decision, error)
+
+// ByPeer limits calls by the peer's IP address using the IP limits.
+func ByPeer() Limit {
+	return func(ctx context.Context, rateLimiter *limiter.RateLimiter, fullMethod string) (*limiter.Decision, error) {
+		return rateLimiter.Check(ctx, peerIP(ctx), "")
+	}
+}
+
+// ByAPIKey limits calls by the API key in the metadataKey metadata, falling
+// back to the peer's IP address, exactly like the HTTP middleware does with
+// the API_KEY header.
+func ByAPIKey(metadataKey string) Limit {
+	if metadataKey == "" {
+		metadataKey = DefaultTokenMetadata
+	}
+	return func(ctx context.Context, rateLimiter *limiter.RateLimiter, fullMethod string) (*limiter.Decision, error) {
+		var token string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(metadataKey); len(values) > 0 {
+				token = values[0]
+			}
+		}
+		return rateLimiter.Check(ctx, peerIP(ctx), token)
+	}
+}
+
+// ByMethod limits the calls to each full method name under rule, across all
+// clients.
+func ByMethod(rule limiter.Rule) Limit {
+	return func(ctx context.Context, rateLimiter *limiter.RateLimiter, fullMethod string) (*limiter.Decision, error) {
+		return rateLimiter.Allow(ctx, rule, fullMethod)
+	}
+}
+
+// UnaryServerInterceptor rate-limits unary calls. Every limit is checked in
+// order and the first one that denies the call rejects it with
+// codes.ResourceExhausted, or codes.PermissionDenied for denylisted clients.
+// Without limits, ByAPIKey(DefaultTokenMetadata) is used.
+func UnaryServerInterceptor(rateLimiter *limiter.RateLimiter, limits ...Limit) grpc.UnaryServerInterceptor {
+	limits = defaultLimits(limits)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := check(ctx, rateLimiter, limits, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rate-limits the opening of streams, with the same
+// limits as UnaryServerInterceptor. Messages within a stream are not counted.
+func StreamServerInterceptor(rateLimiter *limiter.RateLimiter, limits ...Limit) grpc.StreamServerInterceptor {
+	limits = defaultLimits(limits)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := check(ss.Context(), rateLimiter, limits, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func defaultLimits(limits []Limit) []Limit {
+	if len(limits) == 0 {
+		return []Limit{ByAPIKey(DefaultTokenMetadata)}
+	}
+	return limits
+}
+
+func check(ctx context.Context, rateLimiter *limiter.RateLimiter, limits []Limit, fullMethod string) error {
+	for _, limit := range limits {
+		decision, err := limit(ctx, rateLimiter, fullMethod)
+		if err != nil {
+			return status.Error(codes.Internal, "Internal server error")
+		}
+		if decision.Denied {
+			return status.Error(codes.PermissionDenied, limiter.AccessDeniedMessage)
+		}
+		if decision.Limited {
+			return limitedError(decision)
+		}
+	}
+	return nil
+}
+
+func limitedError(decision *limiter.Decision) error {
+	message := limiter.LimitExceededMessage
+	if decision.Global {
+		message = limiter.GlobalLimitExceededMessage
+	}
+	st := status.New(codes.ResourceExhausted, message)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(time.Duration(decision.RetryAfter) * time.Second),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
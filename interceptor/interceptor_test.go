@@ -0,0 +1,180 @@
+package interceptor
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"rate-limiter/limiter"
+	"rate-limiter/storage"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func newTestRateLimiter(ipLimit int, tokenLimit int) (*limiter.RateLimiter, *storage.MockStorage) {
+	mockStorage := storage.NewMockStorage()
+	config := &limiter.Config{
+		IPLimit:            ipLimit,
+		IPBlockDuration:    300,
+		TokenLimit:         tokenLimit,
+		TokenBlockDuration: 300,
+	}
+	return limiter.NewRateLimiter(mockStorage, config), mockStorage
+}
+
+func peerContext(ip string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50051},
+	})
+}
+
+func callUnary(interceptor grpc.UnaryServerInterceptor, ctx context.Context, method string) error {
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	_, err := interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	return err
+}
+
+func TestUnaryServerInterceptor_ByPeer(t *testing.T) {
+	rateLimiter, _ := newTestRateLimiter(1, 10)
+	interceptor := UnaryServerInterceptor(rateLimiter, ByPeer())
+	ctx := peerContext("192.168.1.1")
+
+	if err := callUnary(interceptor, ctx, "/test.Service/Get"); err != nil {
+		t.Errorf("First call should be allowed, got %v", err)
+	}
+
+	err := callUnary(interceptor, ctx, "/test.Service/Get")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Second call should be rejected with ResourceExhausted, got %v", err)
+	}
+
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = info
+		}
+	}
+	if retryInfo == nil {
+		t.Fatal("Expected RetryInfo in error details")
+	}
+	if delay := retryInfo.RetryDelay.AsDuration(); delay != 300*time.Second {
+		t.Errorf("Expected retry delay 300s, got %v", delay)
+	}
+
+	if err := callUnary(interceptor, peerContext("192.168.1.2"), "/test.Service/Get"); err != nil {
+		t.Errorf("Other peers should not be limited, got %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor_ByAPIKey(t *testing.T) {
+	rateLimiter, _ := newTestRateLimiter(1, 2)
+	interceptor := UnaryServerInterceptor(rateLimiter)
+	ctx := metadata.NewIncomingContext(peerContext("192.168.1.1"), metadata.Pairs("api_key", "test-token"))
+
+	for i := 0; i < 2; i++ {
+		if err := callUnary(interceptor, ctx, "/test.Service/Get"); err != nil {
+			t.Errorf("Call %d with token should be allowed, got %v", i+1, err)
+		}
+	}
+	if err := callUnary(interceptor, ctx, "/test.Service/Get"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Third call with token should be rejected, got %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor_ByMethod(t *testing.T) {
+	rateLimiter, _ := newTestRateLimiter(10, 10)
+	rule := limiter.Rule{Name: "method", Limit: 1, BlockDuration: 60}
+	interceptor := UnaryServerInterceptor(rateLimiter, ByMethod(rule))
+
+	if err := callUnary(interceptor, peerContext("192.168.1.1"), "/test.Service/Export"); err != nil {
+		t.Errorf("First call should be allowed, got %v", err)
+	}
+	if err := callUnary(interceptor, peerContext("192.168.1.2"), "/test.Service/Export"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Method limit should apply across peers, got %v", err)
+	}
+	if err := callUnary(interceptor, peerContext("192.168.1.2"), "/test.Service/Get"); err != nil {
+		t.Errorf("Other methods should not be limited, got %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor_Denylist(t *testing.T) {
+	config := &limiter.Config{
+		IPLimit:            10,
+		IPBlockDuration:    300,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+		Denylist:           []string{"203.0.113.0/24"},
+	}
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+	interceptor := UnaryServerInterceptor(rateLimiter, ByPeer())
+
+	err := callUnary(interceptor, peerContext("203.0.113.7"), "/test.Service/Get")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for a denylisted peer, got %v", err)
+	}
+	if err := callUnary(interceptor, peerContext("192.168.1.1"), "/test.Service/Get"); err != nil {
+		t.Errorf("Other peers should be allowed, got %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor_StorageError(t *testing.T) {
+	config := &limiter.Config{IPLimit: 5, IPBlockDuration: 300, TokenLimit: 10, TokenBlockDuration: 300}
+	interceptor := UnaryServerInterceptor(limiter.NewRateLimiter(&failingStorage{}, config))
+
+	if err := callUnary(interceptor, peerContext("192.168.1.1"), "/test.Service/Get"); status.Code(err) != codes.Internal {
+		t.Errorf("Expected Internal error, got %v", err)
+	}
+}
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	rateLimiter, mockStorage := newTestRateLimiter(5, 10)
+	mockStorage.SetBlocked("ip:192.168.1.1", true)
+	interceptor := StreamServerInterceptor(rateLimiter, ByPeer())
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Watch"}
+
+	called := false
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		called = true
+		return nil
+	}
+
+	err := interceptor(nil, &testServerStream{ctx: peerContext("192.168.1.1")}, info, handler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Stream from blocked peer should be rejected, got %v", err)
+	}
+	if called {
+		t.Error("Handler should not be called for a rejected stream")
+	}
+
+	if err := interceptor(nil, &testServerStream{ctx: peerContext("192.168.1.2")}, info, handler); err != nil {
+		t.Errorf("Stream should be allowed, got %v", err)
+	}
+	if !called {
+		t.Error("Handler should be called for an allowed stream")
+	}
+}
+
+type failingStorage struct {
+	storage.MockStorage
+}
+
+func (f *failingStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return false, context.DeadlineExceeded
+}
@@ -0,0 +1,249 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+// AccessDeniedMessage is the error message returned to denylisted clients.
+const AccessDeniedMessage = "access denied"
+
+const defaultAccessListRefresh = 10 * time.Second
+
+// List names an access list.
+type List string
+
+const (
+	// Allowlist entries bypass the limits and are not counted.
+	Allowlist List = "allowlist"
+	// Denylist entries are rejected before any limit. A request on both lists
+	// is denied.
+	Denylist List = "denylist"
+)
+
+// accessKeyPrefix marks the entries that are API keys rather than addresses.
+const accessKeyPrefix = "key:"
+
+// ParseAccessList parses a comma-separated ALLOWLIST or DENYLIST, e.g.
+//
+//	10.0.0.0/8,2001:db8::/32,127.0.0.1,key:health-checker
+//
+// Entries are CIDRs, single IPs or "key:" followed by an API key.
+func ParseAccessList(value string) ([]string, error) {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if err := validateAccessEntry(entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// AccessLists holds the allowlist and denylist. Entries from the
+// configuration are fixed. Entries added with Add are kept in the storage when
+// it is a storage.ListStorage, so every instance sharing it applies them
+// within the refresh interval.
+type AccessLists struct {
+	config   map[List][]string
+	store    storage.ListStorage
+	interval time.Duration
+	now      func() time.Time
+
+	mutex      sync.RWMutex
+	sets       map[List]*accessSet
+	loadedAt   time.Time
+	refreshing atomic.Bool
+}
+
+// accessSet matches addresses with a prefix trie and API keys exactly.
+type accessSet struct {
+	networks ipTrie
+	keys     map[string]struct{}
+}
+
+func newAccessLists(store storage.Storage, config *Config) *AccessLists {
+	a := &AccessLists{
+		config: map[List][]string{
+			Allowlist: config.Allowlist,
+			Denylist:  config.Denylist,
+		},
+		interval: config.AccessListRefresh,
+		now:      time.Now,
+	}
+	if a.interval <= 0 {
+		a.interval = defaultAccessListRefresh
+	}
+	if lists, ok := store.(storage.ListStorage); ok {
+		a.store = lists
+	}
+	a.sets = a.build(nil)
+	return a
+}
+
+// Add adds entry to list in the storage and reloads the lists.
+func (a *AccessLists) Add(ctx context.Context, list List, entry string) error {
+	if err := a.writable(list, entry); err != nil {
+		return err
+	}
+	if err := a.store.AddListEntry(ctx, string(list), entry); err != nil {
+		return err
+	}
+	return a.Refresh(ctx)
+}
+
+// Remove removes entry from list in the storage and reloads the lists.
+// Entries from the configuration cannot be removed.
+func (a *AccessLists) Remove(ctx context.Context, list List, entry string) error {
+	if err := a.writable(list, entry); err != nil {
+		return err
+	}
+	if err := a.store.RemoveListEntry(ctx, string(list), entry); err != nil {
+		return err
+	}
+	return a.Refresh(ctx)
+}
+
+// Refresh reloads the entries kept in the storage.
+func (a *AccessLists) Refresh(ctx context.Context) error {
+	if a.store == nil {
+		return nil
+	}
+
+	stored := make(map[List][]string)
+	for _, list := range []List{Allowlist, Denylist} {
+		entries, err := a.store.ListEntries(ctx, string(list))
+		if err != nil {
+			return err
+		}
+		stored[list] = entries
+	}
+
+	sets := a.build(stored)
+	a.mutex.Lock()
+	a.sets = sets
+	a.loadedAt = a.now()
+	a.mutex.Unlock()
+	return nil
+}
+
+// match returns the list ip or token is on, the denylist first.
+func (a *AccessLists) match(ip string, token string) (List, bool) {
+	a.refreshIfStale()
+
+	addr, err := netip.ParseAddr(ip)
+	hasAddr := err == nil
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, list := range []List{Denylist, Allowlist} {
+		set := a.sets[list]
+		if hasAddr && set.networks.contains(addr) {
+			return list, true
+		}
+		if _, exists := set.keys[token]; token != "" && exists {
+			return list, true
+		}
+	}
+	return "", false
+}
+
+// refreshIfStale reloads the lists in the background once the refresh
+// interval has passed, so requests never wait for it.
+func (a *AccessLists) refreshIfStale() {
+	if a.store == nil {
+		return
+	}
+	a.mutex.RLock()
+	stale := a.now().Sub(a.loadedAt) >= a.interval
+	a.mutex.RUnlock()
+	if !stale || !a.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer a.refreshing.Store(false)
+		// On failure the previous entries stay until the next attempt.
+		a.Refresh(context.Background())
+	}()
+}
+
+func (a *AccessLists) build(stored map[List][]string) map[List]*accessSet {
+	sets := make(map[List]*accessSet)
+	for _, list := range []List{Allowlist, Denylist} {
+		set := &accessSet{keys: make(map[string]struct{})}
+		for _, entry := range a.config[list] {
+			set.add(entry)
+		}
+		for _, entry := range stored[list] {
+			// Entries written to the storage by hand may be malformed.
+			if validateAccessEntry(entry) == nil {
+				set.add(entry)
+			}
+		}
+		sets[list] = set
+	}
+	return sets
+}
+
+func (a *AccessLists) writable(list List, entry string) error {
+	if list != Allowlist && list != Denylist {
+		return fmt.Errorf("unknown list %q", list)
+	}
+	if a.store == nil {
+		return fmt.Errorf("storage does not support access lists")
+	}
+	return validateAccessEntry(entry)
+}
+
+func (s *accessSet) add(entry string) {
+	if key, found := strings.CutPrefix(entry, accessKeyPrefix); found {
+		s.keys[key] = struct{}{}
+		return
+	}
+	if prefix, ok := parseNetwork(entry); ok {
+		s.networks.insert(prefix)
+	}
+}
+
+func validateAccessEntry(entry string) error {
+	if key, found := strings.CutPrefix(entry, accessKeyPrefix); found {
+		if key == "" {
+			return fmt.Errorf("invalid access list entry %q: empty API key", entry)
+		}
+		return nil
+	}
+	if _, ok := parseNetwork(entry); !ok {
+		return fmt.Errorf("invalid access list entry %q: expected a CIDR, an IP or key:<API key>", entry)
+	}
+	return nil
+}
+
+// parseNetwork reads a CIDR or a single IP, IPv4-mapped IPv6 addresses
+// included, as a network.
+func parseNetwork(entry string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		addr := prefix.Addr()
+		if addr.Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96), true
+		}
+		return prefix, true
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
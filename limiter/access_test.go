@@ -0,0 +1,163 @@
+package limiter
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+func TestIPTrie(t *testing.T) {
+	var trie ipTrie
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.7/32", "2001:db8::/32", "10.1.0.0/16"} {
+		trie.insert(netip.MustParsePrefix(cidr))
+	}
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.255.0.1", true},
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		if got := trie.contains(netip.MustParseAddr(tt.ip)); got != tt.expected {
+			t.Errorf("contains(%s): expected %v, got %v", tt.ip, tt.expected, got)
+		}
+	}
+
+	var empty ipTrie
+	if empty.contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("Expected empty trie to contain nothing")
+	}
+}
+
+func TestParseAccessList(t *testing.T) {
+	entries, err := ParseAccessList(" 10.0.0.0/8, 127.0.0.1 ,key:health,,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(entries) != 4 || entries[1] != "127.0.0.1" || entries[2] != "key:health" {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+
+	for _, value := range []string{"10.0.0.0/33", "not-an-ip", "key:"} {
+		if _, err := ParseAccessList(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestCheck_AccessLists(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{
+		IPLimit:            1,
+		IPBlockDuration:    300,
+		TokenLimit:         1,
+		TokenBlockDuration: 300,
+		Allowlist:          []string{"10.0.0.0/8", "key:health"},
+		Denylist:           []string{"203.0.113.0/24", "10.6.6.6", "key:stolen"},
+	}
+	rl := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		decision, _ := rl.Check(ctx, "10.1.2.3", "")
+		if decision.Limited || !decision.Allowlisted {
+			t.Errorf("Request %d: expected allowlisted IP to bypass limits, got %+v", i+1, decision)
+		}
+		decision, _ = rl.Check(ctx, "198.51.100.1", "health")
+		if decision.Limited || !decision.Allowlisted {
+			t.Errorf("Request %d: expected allowlisted key to bypass limits, got %+v", i+1, decision)
+		}
+	}
+	if count, _ := mockStorage.GetCounter(ctx, "ip:10.1.2.3"); count != 0 {
+		t.Errorf("Expected allowlisted requests not to be counted, got %d", count)
+	}
+
+	tests := []struct {
+		ip    string
+		token string
+	}{
+		{"203.0.113.9", ""},
+		{"10.6.6.6", ""},
+		{"198.51.100.1", "stolen"},
+		{"203.0.113.9", "health"},
+	}
+	for _, tt := range tests {
+		decision, _ := rl.Check(ctx, tt.ip, tt.token)
+		if !decision.Limited || !decision.Denied {
+			t.Errorf("Check(%s, %q): expected denied, got %+v", tt.ip, tt.token, decision)
+		}
+	}
+
+	decision, _ := rl.PeekN(ctx, "203.0.113.9", "", 1)
+	if !decision.Denied {
+		t.Errorf("Expected PeekN to deny, got %+v", decision)
+	}
+
+	decision, _ = rl.Check(ctx, "198.51.100.1", "")
+	if decision.Limited || decision.Denied || decision.Allowlisted {
+		t.Errorf("Expected unlisted request to be counted, got %+v", decision)
+	}
+}
+
+func TestAccessLists_Runtime(t *testing.T) {
+	memoryStorage := storage.NewMemoryStorage(storage.MemoryOptions{})
+	defer memoryStorage.Close()
+	config := &Config{IPLimit: 10, IPBlockDuration: 60, AccessListRefresh: time.Minute}
+	instanceA := NewRateLimiter(memoryStorage, config)
+	instanceB := NewRateLimiter(memoryStorage, config)
+	ctx := context.Background()
+
+	if err := instanceA.AccessLists().Add(ctx, Denylist, "198.51.100.0/24"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decision, _ := instanceA.Check(ctx, "198.51.100.7", ""); !decision.Denied {
+		t.Errorf("Expected the instance that added the entry to deny at once, got %+v", decision)
+	}
+
+	now := time.Now()
+	instanceB.AccessLists().now = func() time.Time { return now }
+	instanceB.AccessLists().Refresh(ctx)
+	if decision, _ := instanceB.Check(ctx, "198.51.100.7", ""); !decision.Denied {
+		t.Errorf("Expected other instances to share the entry, got %+v", decision)
+	}
+
+	instanceA.AccessLists().Remove(ctx, Denylist, "198.51.100.0/24")
+	if decision, _ := instanceB.Check(ctx, "198.51.100.7", ""); !decision.Denied {
+		t.Errorf("Expected the entry to stay until the next refresh, got %+v", decision)
+	}
+
+	now = now.Add(time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if decision, _ := instanceB.Check(ctx, "198.51.100.7", ""); !decision.Denied {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the removal to reach other instances after the refresh interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := instanceA.AccessLists().Add(ctx, Allowlist, "bad/entry"); err == nil {
+		t.Error("Expected error for an invalid entry")
+	}
+	if err := instanceA.AccessLists().Add(ctx, "graylist", "10.0.0.1"); err == nil {
+		t.Error("Expected error for an unknown list")
+	}
+
+	rl := NewRateLimiter(storage.NewMockStorage(), config)
+	if err := rl.AccessLists().Add(ctx, Denylist, "10.0.0.1"); err == nil {
+		t.Error("Expected error when the storage cannot hold lists")
+	}
+}
@@ -0,0 +1,177 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAdaptiveMinScale = 0.1
+	defaultAdaptiveMaxScale = 1
+	defaultAdaptiveInterval = 5 * time.Second
+
+	// adaptiveIncrease is added to the scale after a healthy interval, and
+	// adaptiveBackoff multiplies it after an overloaded one.
+	adaptiveIncrease = 0.05
+	adaptiveBackoff  = 0.8
+	// adaptiveMinSamples keeps a few slow requests on a quiet instance from
+	// moving the limits: an interval is only judged once it has this many.
+	adaptiveMinSamples = 10
+)
+
+// AdaptiveStats is the state of the adaptive limits. Latency, ErrorRate and
+// Requests describe the last interval judged; Limits are the effective limits
+// of the window rules and of the concurrency limit, keyed by rule name and
+// "concurrency".
+type AdaptiveStats struct {
+	Scale     float64        `json:"scale"`
+	Latency   float64        `json:"latency_ms"`
+	ErrorRate float64        `json:"error_rate"`
+	Requests  int64          `json:"requests"`
+	Increases int64          `json:"increases"`
+	Decreases int64          `json:"decreases"`
+	Limits    map[string]int `json:"limits"`
+}
+
+// adaptive scales limits with AIMD: the scale shrinks by adaptiveBackoff
+// after each interval in which the average latency or the failure rate went
+// over its target, and grows by adaptiveIncrease after the others, within
+// [minScale, maxScale].
+type adaptive struct {
+	latency   time.Duration
+	errorRate float64
+	minScale  float64
+	maxScale  float64
+	interval  time.Duration
+	now       func() time.Time
+
+	mutex       sync.Mutex
+	scale       float64
+	windowStart time.Time
+	requests    int64
+	failures    int64
+	latencySum  time.Duration
+	stats       AdaptiveStats
+}
+
+func newAdaptive(config *Config) *adaptive {
+	if config.AdaptiveLatency <= 0 && config.AdaptiveErrorRate <= 0 {
+		return nil
+	}
+	a := &adaptive{
+		latency:   config.AdaptiveLatency,
+		errorRate: config.AdaptiveErrorRate,
+		minScale:  config.AdaptiveMinScale,
+		maxScale:  config.AdaptiveMaxScale,
+		interval:  config.AdaptiveInterval,
+		now:       time.Now,
+	}
+	if a.minScale <= 0 {
+		a.minScale = defaultAdaptiveMinScale
+	}
+	if a.maxScale <= 0 {
+		a.maxScale = defaultAdaptiveMaxScale
+	}
+	if a.interval <= 0 {
+		a.interval = defaultAdaptiveInterval
+	}
+	a.scale = math.Max(math.Min(1, a.maxScale), a.minScale)
+	a.windowStart = a.now()
+	return a
+}
+
+// Adaptive reports whether adaptive limits are enabled.
+func (rl *RateLimiter) Adaptive() bool {
+	return rl.adaptive != nil
+}
+
+// Observe feeds the adaptive limits with a handled request: how long the
+// handler took and whether it failed, e.g. with a 5xx status. It does nothing
+// when adaptive limits are disabled.
+func (rl *RateLimiter) Observe(latency time.Duration, failed bool) {
+	if rl.adaptive != nil {
+		rl.adaptive.observe(latency, failed)
+	}
+}
+
+// AdaptiveStats returns the state of the adaptive limits, or nil when they
+// are disabled.
+func (rl *RateLimiter) AdaptiveStats() *AdaptiveStats {
+	if rl.adaptive == nil {
+		return nil
+	}
+	rl.adaptive.mutex.Lock()
+	stats := rl.adaptive.stats
+	stats.Scale = rl.adaptive.scale
+	rl.adaptive.mutex.Unlock()
+
+	rules := []Rule{rl.config.ipRule(), rl.config.tokenRule()}
+	for _, rule := range rl.config.Rules {
+		rules = append(rules, rule)
+	}
+	stats.Limits = make(map[string]int)
+	for _, rule := range rules {
+		if rule.Period == "" {
+			stats.Limits[rule.Name] = rl.adapt(rule).Limit
+		}
+	}
+	if rl.config.ConcurrencyLimit > 0 {
+		stats.Limits["concurrency"] = rl.adaptive.scaleLimit(rl.config.ConcurrencyLimit)
+	}
+	return &stats
+}
+
+// adapt returns rule with its limit scaled by the adaptive limits. Calendar
+// quotas are not scaled.
+func (rl *RateLimiter) adapt(rule Rule) Rule {
+	if rl.adaptive == nil || rule.Period != "" {
+		return rule
+	}
+	rule.Limit = rl.adaptive.scaleLimit(rule.Limit)
+	return rule
+}
+
+func (a *adaptive) scaleLimit(limit int) int {
+	if a == nil {
+		return limit
+	}
+	a.mutex.Lock()
+	scale := a.scale
+	a.mutex.Unlock()
+	return max(int(math.Round(float64(limit)*scale)), 1)
+}
+
+func (a *adaptive) observe(latency time.Duration, failed bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.requests++
+	a.latencySum += latency
+	if failed {
+		a.failures++
+	}
+
+	now := a.now()
+	if now.Sub(a.windowStart) < a.interval || a.requests < adaptiveMinSamples {
+		return
+	}
+
+	average := a.latencySum / time.Duration(a.requests)
+	failureRate := float64(a.failures) / float64(a.requests)
+	overloaded := (a.latency > 0 && average > a.latency) ||
+		(a.errorRate > 0 && failureRate > a.errorRate)
+	if overloaded {
+		a.scale = math.Max(a.scale*adaptiveBackoff, a.minScale)
+		a.stats.Decreases++
+	} else {
+		a.scale = math.Min(a.scale+adaptiveIncrease, a.maxScale)
+		a.stats.Increases++
+	}
+
+	a.stats.Latency = float64(average) / float64(time.Millisecond)
+	a.stats.ErrorRate = failureRate
+	a.stats.Requests = a.requests
+	a.windowStart = now
+	a.requests, a.failures, a.latencySum = 0, 0, 0
+}
@@ -0,0 +1,124 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+// newTestAdaptive returns a rate limiter with adaptive limits judged every
+// minute of the returned clock.
+func newTestAdaptive(config *Config) (*RateLimiter, *time.Time) {
+	config.AdaptiveInterval = time.Minute
+	rl := NewRateLimiter(storage.NewMockStorage(), config)
+	now := time.Now()
+	rl.adaptive.now = func() time.Time { return now }
+	rl.adaptive.windowStart = now
+	return rl, &now
+}
+
+// observeInterval feeds one interval of adaptiveMinSamples requests.
+func observeInterval(rl *RateLimiter, now *time.Time, latency time.Duration, failures int) {
+	*now = now.Add(time.Minute)
+	for i := 0; i < adaptiveMinSamples; i++ {
+		rl.Observe(latency, i < failures)
+	}
+}
+
+func TestAdaptive_AIMD(t *testing.T) {
+	rl, now := newTestAdaptive(&Config{
+		IPLimit:           100,
+		IPBlockDuration:   60,
+		TokenLimit:        1000,
+		AdaptiveLatency:   200 * time.Millisecond,
+		AdaptiveErrorRate: 0.1,
+		AdaptiveMinScale:  0.5,
+	})
+
+	if limit := rl.adapt(rl.config.ipRule()).Limit; limit != 100 {
+		t.Fatalf("Expected the configured limit before any observation, got %d", limit)
+	}
+
+	observeInterval(rl, now, 500*time.Millisecond, 0)
+	if limit := rl.adapt(rl.config.ipRule()).Limit; limit != 80 {
+		t.Errorf("Expected slow requests to cut the limit to 80, got %d", limit)
+	}
+	observeInterval(rl, now, 10*time.Millisecond, 5)
+	if limit := rl.adapt(rl.config.ipRule()).Limit; limit != 64 {
+		t.Errorf("Expected failures to cut the limit to 64, got %d", limit)
+	}
+	for i := 0; i < 5; i++ {
+		observeInterval(rl, now, 500*time.Millisecond, 0)
+	}
+	if limit := rl.adapt(rl.config.ipRule()).Limit; limit != 50 {
+		t.Errorf("Expected the limit to stop at the minimum scale, got %d", limit)
+	}
+
+	// Too few requests to judge the interval.
+	*now = now.Add(time.Minute)
+	rl.Observe(10*time.Millisecond, false)
+	if limit := rl.adapt(rl.config.ipRule()).Limit; limit != 50 {
+		t.Errorf("Expected a quiet interval not to move the limit, got %d", limit)
+	}
+
+	for i := 0; i < 20; i++ {
+		observeInterval(rl, now, 10*time.Millisecond, 0)
+	}
+	if limit := rl.adapt(rl.config.ipRule()).Limit; limit != 100 {
+		t.Errorf("Expected healthy intervals to restore the limit up to the maximum scale, got %d", limit)
+	}
+
+	stats := rl.AdaptiveStats()
+	if stats.Scale != 1 || stats.Decreases != 7 || stats.Increases != 20 || stats.Requests != 10 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.Limits["ip"] != 100 || stats.Limits["token"] != 1000 {
+		t.Errorf("Unexpected effective limits %v", stats.Limits)
+	}
+}
+
+func TestCheck_Adaptive(t *testing.T) {
+	rl, now := newTestAdaptive(&Config{
+		IPLimit:           10,
+		IPBlockDuration:   60,
+		ConcurrencyLimit:  10,
+		AdaptiveErrorRate: 0.1,
+		Rules: map[string]Rule{
+			"api": {Name: "api", Limit: 10, Period: PeriodDay},
+		},
+	})
+	ctx := context.Background()
+
+	observeInterval(rl, now, 0, adaptiveMinSamples)
+	observeInterval(rl, now, 0, adaptiveMinSamples)
+	observeInterval(rl, now, 0, adaptiveMinSamples)
+
+	for i := 1; i <= 6; i++ {
+		decision, err := rl.Check(ctx, "192.168.1.1", "")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if decision.Limit != 5 || decision.Limited != (i > 5) {
+			t.Errorf("Request %d: expected the limit scaled to 5, got %+v", i, decision)
+		}
+	}
+
+	stats := rl.AdaptiveStats()
+	if stats.Limits["concurrency"] != 5 {
+		t.Errorf("Expected the concurrency limit scaled to 5, got %v", stats.Limits)
+	}
+	if _, exists := stats.Limits["api"]; exists {
+		t.Errorf("Expected calendar quotas not to be scaled, got %v", stats.Limits)
+	}
+	if decision, _ := rl.Allow(ctx, rl.config.Rules["api"], "user-1"); decision.Limit != 10 {
+		t.Errorf("Expected the quota limit to stay 10, got %+v", decision)
+	}
+
+	disabled := NewRateLimiter(storage.NewMockStorage(), &Config{IPLimit: 10})
+	disabled.Observe(time.Hour, true)
+	if disabled.Adaptive() || disabled.AdaptiveStats() != nil {
+		t.Error("Expected adaptive limits to be disabled without targets")
+	}
+}
@@ -0,0 +1,118 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+// ConcurrencyExceededMessage is the error message returned to clients with
+// too many requests in flight.
+const ConcurrencyExceededMessage = "too many concurrent requests"
+
+const defaultConcurrencyLease = 30 * time.Second
+
+// Lease is an in-flight slot taken by Acquire. It is renewed in the background
+// until released; if the instance dies the slot frees itself when the last
+// renewal runs out.
+type Lease struct {
+	semaphores storage.SemaphoreStorage
+	key        string
+	holder     string
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// Acquire takes one of the ConcurrencyLimit in-flight slots of ip, or of
+// token when one is given, to be released when the request ends. When every
+// slot is taken it returns a nil Lease and a limited decision. Without a
+// ConcurrencyLimit, and for allowlisted requests, it returns a nil Lease and
+// an unlimited decision.
+func (rl *RateLimiter) Acquire(ctx context.Context, ip string, token string) (*Lease, *Decision, error) {
+	limit := rl.config.ConcurrencyLimit
+	if limit <= 0 {
+		return nil, &Decision{}, nil
+	}
+	limit = rl.adaptive.scaleLimit(limit)
+	if decision, listed := rl.accessDecision(ip, token); listed {
+		return nil, decision, nil
+	}
+	semaphores, ok := rl.storage.(storage.SemaphoreStorage)
+	if !ok {
+		return nil, nil, fmt.Errorf("storage does not support concurrency limits")
+	}
+
+	rule, id := rl.config.subject(rl.config.ipID(ip), token)
+	lease := &Lease{
+		semaphores: semaphores,
+		key:        "inflight:" + rule.key(id),
+		holder:     newHolderID(),
+		stop:       make(chan struct{}),
+	}
+	duration := rl.config.concurrencyLease()
+
+	acquired, err := semaphores.Acquire(ctx, lease.key, lease.holder, limit, duration)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !acquired {
+		return nil, &Decision{Limited: true, Limit: limit, RetryAfter: 1}, nil
+	}
+
+	go lease.renew(limit, duration)
+	return lease, &Decision{Limit: limit}, nil
+}
+
+// Release frees the slot. It is safe to call on a nil Lease and more than
+// once.
+func (l *Lease) Release(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	released := false
+	l.once.Do(func() {
+		close(l.stop)
+		released = true
+	})
+	if !released {
+		return nil
+	}
+	return l.semaphores.Release(ctx, l.key, l.holder)
+}
+
+// renew extends the lease every third of its duration, so a slow request
+// keeps its slot while a failed renewal or two do not lose it.
+func (l *Lease) renew(limit int, duration time.Duration) {
+	ticker := time.NewTicker(duration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), duration/3)
+			l.semaphores.Acquire(ctx, l.key, l.holder, limit, duration)
+			cancel()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (c *Config) concurrencyLease() time.Duration {
+	if c.ConcurrencyLease > 0 {
+		return c.ConcurrencyLease
+	}
+	return defaultConcurrencyLease
+}
+
+func newHolderID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,70 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+func TestAcquire(t *testing.T) {
+	memoryStorage := storage.NewMemoryStorage(storage.MemoryOptions{})
+	defer memoryStorage.Close()
+	config := &Config{ConcurrencyLimit: 2, Allowlist: []string{"10.0.0.0/8"}}
+	rateLimiter := NewRateLimiter(memoryStorage, config)
+	ctx := context.Background()
+
+	first, decision, err := rateLimiter.Acquire(ctx, "192.168.1.1", "")
+	if err != nil || first == nil || decision.Limited {
+		t.Fatalf("Expected a slot, got %v, %+v, %v", first, decision, err)
+	}
+	second, _, _ := rateLimiter.Acquire(ctx, "192.168.1.1", "")
+
+	lease, decision, _ := rateLimiter.Acquire(ctx, "192.168.1.1", "")
+	if lease != nil || !decision.Limited || decision.Limit != 2 {
+		t.Errorf("Expected no slot left, got %+v", decision)
+	}
+	if lease, _, _ := rateLimiter.Acquire(ctx, "192.168.1.1", "abc"); lease == nil {
+		t.Error("Expected tokens to have their own slots")
+	}
+	if lease, decision, _ := rateLimiter.Acquire(ctx, "10.1.1.1", ""); lease != nil || decision.Limited {
+		t.Errorf("Expected allowlisted requests to bypass the limit, got %+v", decision)
+	}
+
+	first.Release(ctx)
+	first.Release(ctx)
+	if lease, _, _ := rateLimiter.Acquire(ctx, "192.168.1.1", ""); lease == nil {
+		t.Error("Expected the released slot to be free")
+	}
+	second.Release(ctx)
+
+	var none *Lease
+	if err := none.Release(ctx); err != nil {
+		t.Errorf("Expected releasing a nil lease to do nothing, got %v", err)
+	}
+
+	if lease, decision, err := NewRateLimiter(memoryStorage, &Config{}).Acquire(ctx, "192.168.1.1", ""); lease != nil || decision.Limited || err != nil {
+		t.Errorf("Expected no limit without ConcurrencyLimit, got %+v, %v", decision, err)
+	}
+	if _, _, err := NewRateLimiter(storage.NewMockStorage(), config).Acquire(ctx, "192.168.1.1", ""); err == nil {
+		t.Error("Expected error when the storage cannot hold semaphores")
+	}
+}
+
+func TestLease_Renew(t *testing.T) {
+	memoryStorage := storage.NewMemoryStorage(storage.MemoryOptions{})
+	defer memoryStorage.Close()
+	config := &Config{ConcurrencyLimit: 1, ConcurrencyLease: 30 * time.Millisecond}
+	rateLimiter := NewRateLimiter(memoryStorage, config)
+	ctx := context.Background()
+
+	lease, _, _ := rateLimiter.Acquire(ctx, "192.168.1.1", "")
+	defer lease.Release(ctx)
+
+	// A request longer than its lease keeps the slot while it runs.
+	time.Sleep(100 * time.Millisecond)
+	if other, _, _ := rateLimiter.Acquire(ctx, "192.168.1.1", ""); other != nil {
+		t.Error("Expected the renewed lease to keep its slot")
+	}
+}
@@ -0,0 +1,108 @@
+package limiter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dryRunLogKeys bounds how many keys are remembered to log once per block.
+const dryRunLogKeys = 10000
+
+// redactKey keys the hashes of redactID. It is random per process, so the
+// hashes of IPv4 addresses cannot be reversed by hashing all of them.
+var redactKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("rate limiter: failed to generate redaction key: %v", err))
+	}
+	return key
+}()
+
+// dryRunCounts counts the requests each dry-run rule would have limited, and
+// remembers until when each key's would-be block was logged.
+type dryRunCounts struct {
+	mutex    sync.Mutex
+	counts   map[string]int64
+	loggedTo map[string]time.Time
+}
+
+func newDryRunCounts() *dryRunCounts {
+	return &dryRunCounts{
+		counts:   make(map[string]int64),
+		loggedTo: make(map[string]time.Time),
+	}
+}
+
+// DryRunStats returns how many requests each dry-run rule would have limited,
+// keyed by rule name.
+func (rl *RateLimiter) DryRunStats() map[string]int64 {
+	rl.dryRun.mutex.Lock()
+	defer rl.dryRun.mutex.Unlock()
+
+	stats := make(map[string]int64, len(rl.dryRun.counts))
+	for name, count := range rl.dryRun.counts {
+		stats[name] = count
+	}
+	return stats
+}
+
+// shadow lets through a request that the dry-run rule limited, recording that
+// it would have been limited. Every such request is counted, but a key is
+// logged once per would-be block, without the key itself since it may be an
+// API key.
+func (rl *RateLimiter) shadow(rule Rule, id string, decision *Decision) *Decision {
+	now := rl.now()
+	key := rule.key(id)
+
+	rl.dryRun.mutex.Lock()
+	rl.dryRun.counts[rule.Name]++
+	logged := rl.dryRun.shouldLog(key, now, time.Duration(max(decision.RetryAfter, 1))*time.Second)
+	rl.dryRun.mutex.Unlock()
+
+	if logged {
+		subject, hashed := redactID(id)
+		log.Printf("rate limiter: dry-run rule %q would limit %s %s for %ds", rule.Name, subject, hashed, decision.RetryAfter)
+	}
+	return &Decision{Limit: decision.Limit, WouldLimit: rule.Name}
+}
+
+// shouldLog reports whether the would-be block of key starting at now is not
+// logged yet, and remembers it for duration. d must be locked.
+func (d *dryRunCounts) shouldLog(key string, now time.Time, duration time.Duration) bool {
+	if now.Before(d.loggedTo[key]) {
+		return false
+	}
+	if len(d.loggedTo) >= dryRunLogKeys {
+		for k, until := range d.loggedTo {
+			if !now.Before(until) {
+				delete(d.loggedTo, k)
+			}
+		}
+		if len(d.loggedTo) >= dryRunLogKeys {
+			// Too many keys blocked at once: the counts still have them.
+			return false
+		}
+	}
+	d.loggedTo[key] = now.Add(duration)
+	return true
+}
+
+// redactID returns the kind of subject of id ("ip", "token" or "key") and a
+// pseudonym for id: a short HMAC under redactKey, which tells keys apart
+// within a process without revealing them.
+func redactID(id string) (string, string) {
+	subject := "key"
+	if kind, _, found := strings.Cut(id, ":"); found && (kind == "ip" || kind == "token") {
+		subject = kind
+	}
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(id))
+	return subject, hex.EncodeToString(mac.Sum(nil)[:6])
+}
@@ -0,0 +1,121 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+func TestAllow_DryRun(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	rl := NewRateLimiter(mockStorage, &Config{})
+	rule := Rule{Name: "export_new", Limit: 2, BlockDuration: 60, DryRun: true}
+	ctx := context.Background()
+
+	for i := 1; i <= 4; i++ {
+		decision, err := rl.Allow(ctx, rule, "user-1")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if decision.Limited {
+			t.Errorf("Request %d: expected a dry-run rule never to limit, got %+v", i, decision)
+		}
+		if wouldLimit := i > 2; (decision.WouldLimit == "export_new") != wouldLimit {
+			t.Errorf("Request %d: expected would limit %v, got %+v", i, wouldLimit, decision)
+		}
+	}
+
+	if blocked, _ := mockStorage.IsBlocked(ctx, "export_new:user-1"); !blocked {
+		t.Error("Expected the dry-run rule to keep its own block")
+	}
+	if stats := rl.DryRunStats(); stats["export_new"] != 2 {
+		t.Errorf("Expected 2 would-be denials, got %v", stats)
+	}
+
+	decision, _ := rl.Allow(ctx, Rule{Name: "export", Limit: 2, BlockDuration: 60}, "user-1")
+	if decision.Limited || decision.WouldLimit != "" {
+		t.Errorf("Expected the enforced rule not to share the dry-run counters, got %+v", decision)
+	}
+}
+
+func TestAllow_DryRunLog(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	rl := NewRateLimiter(storage.NewMockStorage(), &Config{})
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+	rule := Rule{Name: "export_new", Limit: 1, BlockDuration: 60, DryRun: true}
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		rl.Allow(ctx, rule, "token:secret-api-key")
+	}
+	if lines := strings.Count(output.String(), "\n"); lines != 1 {
+		t.Errorf("Expected one log line per would-be block, got %d: %s", lines, output.String())
+	}
+	if strings.Contains(output.String(), "secret-api-key") || !strings.Contains(output.String(), "token") {
+		t.Errorf("Expected the key to be redacted, got %s", output.String())
+	}
+	if stats := rl.DryRunStats(); stats["export_new"] != 4 {
+		t.Errorf("Expected every would-be denial to be counted, got %v", stats)
+	}
+
+	now = now.Add(time.Minute)
+	rl.Allow(ctx, rule, "token:secret-api-key")
+	if lines := strings.Count(output.String(), "\n"); lines != 2 {
+		t.Errorf("Expected the key to be logged again once the block ends, got %d lines", lines)
+	}
+}
+
+func TestCheckRoutes_DryRun(t *testing.T) {
+	config := &Config{
+		Rules: map[string]Rule{
+			"export_new": {Name: "export_new", Limit: 1, BlockDuration: 60, Route: Route{Path: "/export"}, DryRun: true},
+			"export":     {Name: "export", Limit: 3, BlockDuration: 60, Route: Route{Path: "/export"}, Global: true},
+		},
+	}
+	rl := NewRateLimiter(storage.NewMockStorage(), config)
+	ctx := context.Background()
+
+	if decision, _ := rl.CheckRoutes(ctx, "GET", "/export", "192.168.1.1", "", 1); decision.WouldLimit != "" {
+		t.Errorf("Expected the first request under the dry-run limit, got %+v", decision)
+	}
+	decision, _ := rl.CheckRoutes(ctx, "GET", "/export", "192.168.1.1", "", 1)
+	if decision.Limited || decision.WouldLimit != "export_new" {
+		t.Errorf("Expected the dry-run rule to report without limiting, got %+v", decision)
+	}
+	rl.CheckRoutes(ctx, "GET", "/export", "192.168.1.1", "", 1)
+	decision, _ = rl.CheckRoutes(ctx, "GET", "/export", "192.168.1.1", "", 1)
+	if !decision.Limited || !decision.Global {
+		t.Errorf("Expected enforced rules to keep limiting, got %+v", decision)
+	}
+}
+
+func TestRedactID(t *testing.T) {
+	subject, hashed := redactID("ip:192.168.1.1")
+	if subject != "ip" || len(hashed) != 12 {
+		t.Errorf("Unexpected redaction %s %s", subject, hashed)
+	}
+	if _, again := redactID("ip:192.168.1.1"); again != hashed {
+		t.Errorf("Expected the same key to get the same pseudonym, got %s and %s", hashed, again)
+	}
+	if _, other := redactID("ip:192.168.1.2"); other == hashed {
+		t.Errorf("Expected different keys to get different pseudonyms, got %s", other)
+	}
+
+	// The pseudonym is keyed, so hashing the candidate IPs does not find it.
+	sum := sha256.Sum256([]byte("ip:192.168.1.1"))
+	if hashed == hex.EncodeToString(sum[:6]) {
+		t.Error("Expected the pseudonym not to be a plain hash of the key")
+	}
+}
@@ -3,105 +3,688 @@ package limiter
 import (
 	"context"
 	"fmt"
+	"math"
+	"net/netip"
 	"os"
 	"strconv"
+	"time"
 
 	"rate-limiter/storage"
 )
 
+// LimitExceededMessage is the error message returned to limited clients.
+const LimitExceededMessage = "you have reached the maximum number of requests or actions allowed within a certain time frame"
+
+// GlobalLimitExceededMessage is the error message returned to clients limited
+// by a global rule, which counts the requests of every client.
+const GlobalLimitExceededMessage = "the service is receiving too many requests, please try again later"
+
 type Config struct {
 	IPLimit            int
 	IPBlockDuration    int
 	TokenLimit         int
 	TokenBlockDuration int
+	// IPMaxBlockDuration, IPPenaltyWindow, TokenMaxBlockDuration and
+	// TokenPenaltyWindow escalate the blocks of the default rules, see Rule.
+	IPMaxBlockDuration    int
+	IPPenaltyWindow       int
+	TokenMaxBlockDuration int
+	TokenPenaltyWindow    int
+	// TokenPeriod and TokenLocation make the token limit a calendar quota per
+	// API key, see Rule.
+	TokenPeriod   Period
+	TokenLocation *time.Location
+	// Rules are the named rules available to Rule, keyed by name.
+	Rules map[string]Rule
+	// RouteCosts are the request costs reported by RouteCost.
+	RouteCosts []RouteCost
+	// IPv4Prefix and IPv6Prefix count every address of a network under one
+	// IP key, e.g. 64 for the /64 an IPv6 client usually controls. Zero
+	// counts each address apart.
+	IPv4Prefix int
+	IPv6Prefix int
+	// Allowlist and Denylist are the fixed access list entries, in the
+	// ParseAccessList format.
+	Allowlist []string
+	Denylist  []string
+	// AccessListRefresh is how often access list entries kept in the storage
+	// are reloaded. Defaults to 10 seconds.
+	AccessListRefresh time.Duration
+	// ConcurrencyLimit caps the requests of an IP or token in flight at once
+	// across instances. Zero disables it.
+	ConcurrencyLimit int
+	// ConcurrencyLease is how long an in-flight slot outlives an instance
+	// that died holding it. Defaults to 30 seconds.
+	ConcurrencyLease time.Duration
+	// AdaptiveLatency and AdaptiveErrorRate enable adaptive limits: the
+	// window limits and the concurrency limit shrink while the average
+	// handler latency or the failure rate observed with Observe go over them,
+	// and grow back otherwise. Zero disables each.
+	AdaptiveLatency   time.Duration
+	AdaptiveErrorRate float64
+	// AdaptiveMinScale and AdaptiveMaxScale bound the factor applied to the
+	// limits. Default to 0.1 and 1.
+	AdaptiveMinScale float64
+	AdaptiveMaxScale float64
+	// AdaptiveInterval is how often the limits are adjusted. Defaults to 5
+	// seconds.
+	AdaptiveInterval time.Duration
+	// ShedCapacity is how many requests per second all instances admit before
+	// Shed starts rejecting the lower PriorityClasses, listed from the lowest
+	// priority to the highest. Zero disables load shedding.
+	ShedCapacity    int
+	PriorityClasses []PriorityClass
+	// PriorityRoutes, PriorityPlans, AnonymousPriority and DefaultPriority
+	// classify requests for Priority.
+	PriorityRoutes    []PriorityRoute
+	PriorityPlans     map[string]string
+	AnonymousPriority string
+	DefaultPriority   string
 }
 
-func NewConfig() *Config {
-	ipLimit, _ := strconv.Atoi(os.Getenv("DEFAULT_IP_LIMIT"))
-	ipBlockDuration, _ := strconv.Atoi(os.Getenv("DEFAULT_IP_BLOCK_DURATION"))
-	tokenLimit, _ := strconv.Atoi(os.Getenv("DEFAULT_TOKEN_LIMIT"))
-	tokenBlockDuration, _ := strconv.Atoi(os.Getenv("DEFAULT_TOKEN_BLOCK_DURATION"))
+// NewConfig builds the configuration from the environment. Unset variables
+// keep their zero value; a variable that does not parse is an error naming it.
+func NewConfig() (*Config, error) {
+	var env envParser
+	ipLimit := env.int("DEFAULT_IP_LIMIT")
+	ipBlockDuration := env.int("DEFAULT_IP_BLOCK_DURATION")
+	tokenLimit := env.int("DEFAULT_TOKEN_LIMIT")
+	tokenBlockDuration := env.int("DEFAULT_TOKEN_BLOCK_DURATION")
+	ipMaxBlockDuration := env.int("DEFAULT_IP_MAX_BLOCK_DURATION")
+	ipPenaltyWindow := env.int("DEFAULT_IP_PENALTY_WINDOW")
+	tokenMaxBlockDuration := env.int("DEFAULT_TOKEN_MAX_BLOCK_DURATION")
+	tokenPenaltyWindow := env.int("DEFAULT_TOKEN_PENALTY_WINDOW")
+	tokenPeriod := parseEnv(&env, "DEFAULT_TOKEN_PERIOD", ParsePeriod)
+	tokenLocation := parseEnv(&env, "DEFAULT_TOKEN_TIMEZONE", time.LoadLocation)
+	rules := parseEnv(&env, "RATE_LIMIT_RULES", ParseRules)
+	routeCosts := parseEnv(&env, "RATE_LIMIT_ROUTE_COSTS", ParseRouteCosts)
+	ipv4Prefix := env.int("IPV4_PREFIX")
+	ipv6Prefix := env.int("IPV6_PREFIX")
+	allowlist := parseEnv(&env, "ALLOWLIST", ParseAccessList)
+	denylist := parseEnv(&env, "DENYLIST", ParseAccessList)
+	accessListRefresh := env.duration("ACCESS_LIST_REFRESH_INTERVAL")
+	concurrencyLimit := env.int("CONCURRENCY_LIMIT")
+	concurrencyLease := env.duration("CONCURRENCY_LEASE")
+	adaptiveLatency := env.duration("ADAPTIVE_LATENCY_TARGET")
+	adaptiveErrorRate := env.float("ADAPTIVE_ERROR_RATE")
+	adaptiveMinScale := env.float("ADAPTIVE_MIN_SCALE")
+	adaptiveMaxScale := env.float("ADAPTIVE_MAX_SCALE")
+	adaptiveInterval := env.duration("ADAPTIVE_INTERVAL")
+	shedCapacity := env.int("SHED_CAPACITY")
+	priorityClasses := parseEnv(&env, "PRIORITY_CLASSES", ParsePriorityClasses)
+	priorityRoutes := parseEnv(&env, "PRIORITY_ROUTES", ParsePriorityRoutes)
+	priorityPlans := parseEnv(&env, "PRIORITY_PLANS", ParsePriorityPlans)
+	if env.err != nil {
+		return nil, env.err
+	}
+	if adaptiveMaxScale > 0 && adaptiveMinScale > adaptiveMaxScale {
+		return nil, fmt.Errorf("invalid ADAPTIVE_MIN_SCALE: greater than ADAPTIVE_MAX_SCALE")
+	}
 
 	return &Config{
-		IPLimit:            ipLimit,
-		IPBlockDuration:    ipBlockDuration,
-		TokenLimit:         tokenLimit,
-		TokenBlockDuration: tokenBlockDuration,
+		IPLimit:               ipLimit,
+		IPBlockDuration:       ipBlockDuration,
+		TokenLimit:            tokenLimit,
+		TokenBlockDuration:    tokenBlockDuration,
+		IPMaxBlockDuration:    ipMaxBlockDuration,
+		IPPenaltyWindow:       ipPenaltyWindow,
+		TokenMaxBlockDuration: tokenMaxBlockDuration,
+		TokenPenaltyWindow:    tokenPenaltyWindow,
+		TokenPeriod:           tokenPeriod,
+		TokenLocation:         tokenLocation,
+		Rules:                 rules,
+		RouteCosts:            routeCosts,
+		IPv4Prefix:            ipv4Prefix,
+		IPv6Prefix:            ipv6Prefix,
+		Allowlist:             allowlist,
+		Denylist:              denylist,
+		AccessListRefresh:     accessListRefresh,
+		ConcurrencyLimit:      concurrencyLimit,
+		ConcurrencyLease:      concurrencyLease,
+		AdaptiveLatency:       adaptiveLatency,
+		AdaptiveErrorRate:     adaptiveErrorRate,
+		AdaptiveMinScale:      adaptiveMinScale,
+		AdaptiveMaxScale:      adaptiveMaxScale,
+		AdaptiveInterval:      adaptiveInterval,
+		ShedCapacity:          shedCapacity,
+		PriorityClasses:       priorityClasses,
+		PriorityRoutes:        priorityRoutes,
+		PriorityPlans:         priorityPlans,
+		AnonymousPriority:     os.Getenv("PRIORITY_ANONYMOUS"),
+		DefaultPriority:       os.Getenv("PRIORITY_DEFAULT"),
+	}, nil
+}
+
+// envParser reads environment variables for NewConfig, keeping the first
+// error so the variables can be read in a row and checked once.
+type envParser struct {
+	err error
+}
+
+func (p *envParser) int(key string) int {
+	return parseEnv(p, key, strconv.Atoi)
+}
+
+func (p *envParser) float(key string) float64 {
+	return parseEnv(p, key, func(value string) (float64, error) {
+		return strconv.ParseFloat(value, 64)
+	})
+}
+
+func (p *envParser) duration(key string) time.Duration {
+	return parseEnv(p, key, time.ParseDuration)
+}
+
+// parseEnv parses the variable key with parse, returning the zero value when
+// it is unset or does not parse.
+func parseEnv[T any](p *envParser, key string, parse func(string) (T, error)) T {
+	var zero T
+	value := os.Getenv(key)
+	if value == "" || p.err != nil {
+		return zero
 	}
+	parsed, err := parse(value)
+	if err != nil {
+		p.err = fmt.Errorf("invalid %s: %v", key, err)
+		return zero
+	}
+	return parsed
+}
+
+// Rule limits the requests counted under "<Name>:<key>" to Limit per window,
+// blocking the key for BlockDuration seconds once the limit is exceeded.
+//
+// When MaxBlockDuration is greater than BlockDuration, repeat offenders are
+// blocked longer: each block that follows another within PenaltyWindow
+// seconds of its end doubles, up to MaxBlockDuration. The offenses of a key
+// are forgotten after PenaltyWindow seconds without a block, which defaults to
+// MaxBlockDuration.
+//
+// A rule with a Period is a quota: Limit applies per calendar day or month in
+// Location (UTC when nil) instead of per window starting at the first request,
+// and keys over it are limited until the period resets.
+//
+// A rule with a Route is also checked by CheckRoutes for the requests it
+// matches, per client or, when Global, across all clients.
+//
+// A DryRun rule never limits: the requests it would limit are let through
+// with Decision.WouldLimit set, logged and counted in DryRunStats.
+type Rule struct {
+	Name             string
+	Limit            int
+	BlockDuration    int
+	MaxBlockDuration int
+	PenaltyWindow    int
+	Period           Period
+	Location         *time.Location
+	Route            Route
+	Global           bool
+	DryRun           bool
 }
 
 type RateLimiter struct {
 	storage storage.Storage
 	config  *Config
+	access  *AccessLists
+	// routeRules are the rules with a Route, in the order CheckRoutes counts
+	// them.
+	routeRules []Rule
+	adaptive   *adaptive
+	dryRun     *dryRunCounts
+	now        func() time.Time
+}
+
+// Decision is the outcome of a rate limit check. RetryAfter is the number of
+// seconds a limited client should wait before trying again. Denied requests
+// are on the denylist and also Limited; Allowlisted requests were not counted
+// and carry no limit. Global is set when a global rule limited the request,
+// and Shed when the request was shed under load. WouldLimit names the dry-run
+// rule that would have limited a request let through.
+type Decision struct {
+	Limited     bool   `json:"limited"`
+	Limit       int    `json:"limit"`
+	Remaining   int    `json:"remaining"`
+	RetryAfter  int    `json:"retry_after"`
+	Denied      bool   `json:"denied,omitempty"`
+	Allowlisted bool   `json:"allowlisted,omitempty"`
+	Global      bool   `json:"global,omitempty"`
+	Shed        bool   `json:"shed,omitempty"`
+	WouldLimit  string `json:"would_limit,omitempty"`
 }
 
 func NewRateLimiter(storage storage.Storage, config *Config) *RateLimiter {
 	return &RateLimiter{
-		storage: storage,
-		config:  config,
+		storage:    storage,
+		config:     config,
+		access:     newAccessLists(storage, config),
+		routeRules: config.routeRules(),
+		adaptive:   newAdaptive(config),
+		dryRun:     newDryRunCounts(),
+		now:        time.Now,
 	}
 }
 
 func (rl *RateLimiter) CheckRateLimit(ctx context.Context, ip string, token string) (bool, error) {
-	ipBlocked, err := rl.storage.IsBlocked(ctx, fmt.Sprintf("ip:%s", ip))
+	decision, err := rl.Check(ctx, ip, token)
 	if err != nil {
 		return false, err
 	}
+	return decision.Limited, nil
+}
+
+// Check counts a request from ip, or from token when one is given, and
+// returns the resulting decision. A blocked IP is limited even when a token is
+// given. The access lists are checked first.
+func (rl *RateLimiter) Check(ctx context.Context, ip string, token string) (*Decision, error) {
+	return rl.CheckN(ctx, ip, token, 1)
+}
+
+// CheckN is Check for a request that costs n units of the limit.
+func (rl *RateLimiter) CheckN(ctx context.Context, ip string, token string, n int) (*Decision, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid cost %d", n)
+	}
+	if decision, listed := rl.accessDecision(ip, token); listed {
+		return decision, nil
+	}
+	ip = rl.config.ipID(ip)
+
+	ipRule := rl.config.ipRule()
+	ipKey := ipRule.key(ip)
+	ipBlocked, err := rl.storage.IsBlocked(ctx, ipKey)
+	if err != nil {
+		return nil, err
+	}
+	if ipBlocked {
+		return rl.blockedDecision(ctx, ipRule, ipKey)
+	}
+
+	rule, id := rl.config.subject(ip, token)
+	return rl.allowN(ctx, rule, id, int64(n), token != "")
+}
+
+// PeekN returns the decision CheckN would make for a request that costs n
+// units, without counting it.
+func (rl *RateLimiter) PeekN(ctx context.Context, ip string, token string, n int) (*Decision, error) {
+	if decision, listed := rl.accessDecision(ip, token); listed {
+		return decision, nil
+	}
+	ip = rl.config.ipID(ip)
+
+	ipRule := rl.config.ipRule()
+	ipKey := ipRule.key(ip)
+	ipBlocked, err := rl.storage.IsBlocked(ctx, ipKey)
+	if err != nil {
+		return nil, err
+	}
 	if ipBlocked {
-		return true, nil
+		return rl.blockedDecision(ctx, ipRule, ipKey)
 	}
 
+	rule, id := rl.config.subject(ip, token)
+	rule = rl.adapt(rule)
+	key := rule.key(id)
 	if token != "" {
-		tokenBlocked, err := rl.storage.IsBlocked(ctx, fmt.Sprintf("token:%s", token))
+		blocked, err := rl.storage.IsBlocked(ctx, key)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		if tokenBlocked {
-			return true, nil
+		if blocked {
+			return rl.blockedDecision(ctx, rule, key)
 		}
+	}
 
-		count, err := rl.storage.Increment(ctx, fmt.Sprintf("token:%s", token))
+	counter, resetAt := rl.counter(rule, id)
+	count, err := rl.storage.GetCounter(ctx, counter)
+	if err != nil {
+		return nil, err
+	}
+	if count+int64(n) > int64(rule.Limit) {
+		if rule.Period != "" {
+			return rl.quotaExceeded(rule, count, resetAt), nil
+		}
+		// The request fits again once the counter's window ends.
+		retryAfter, err := rl.remaining(ctx, counter)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-
-		if count == 1 {
-			err = rl.storage.SetExpiration(ctx, fmt.Sprintf("token:%s", token), rl.config.TokenBlockDuration)
-			if err != nil {
-				return false, err
-			}
+		if retryAfter == 0 {
+			retryAfter = rule.BlockDuration
 		}
+		return limitedDecision(rule, retryAfter), nil
+	}
+
+	return &Decision{
+		Limit:     rule.Limit,
+		Remaining: rule.Limit - int(count),
+	}, nil
+}
+
+// RecordN adds n units to the counter CheckN uses for ip or token, blocking
+// it once it goes over the limit. A negative n refunds units charged earlier.
+func (rl *RateLimiter) RecordN(ctx context.Context, ip string, token string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	if _, listed := rl.access.match(ip, token); listed {
+		return nil
+	}
+	ip = rl.config.ipID(ip)
+
+	rule, id := rl.config.subject(ip, token)
+	key := rule.key(id)
+	counter, resetAt := rl.counter(rule, id)
+
+	if n < 0 {
+		return rl.refund(ctx, counter, int64(-n))
+	}
+
+	if rule.Period != "" {
+		// The response was served: it counts even past the quota.
+		_, err := rl.addQuota(ctx, counter, resetAt, int64(n))
+		return err
+	}
+
+	count, err := rl.add(ctx, rule, key, int64(n))
+	if err != nil {
+		return err
+	}
+	_, err = rl.blockOver(ctx, rl.adapt(rule), key, count, int64(n))
+	return err
+}
+
+// refund takes n units back from counter, never leaving it below zero when
+// its window expired before the refund.
+func (rl *RateLimiter) refund(ctx context.Context, counter string, n int64) error {
+	count, err := rl.storage.IncrementBy(ctx, counter, -n)
+	if err != nil || count >= 0 {
+		return err
+	}
+	_, err = rl.storage.IncrementBy(ctx, counter, -count)
+	return err
+}
+
+// Allow counts a request for key under rule.
+func (rl *RateLimiter) Allow(ctx context.Context, rule Rule, key string) (*Decision, error) {
+	return rl.allowN(ctx, rule, key, 1, true)
+}
+
+// AllowN counts a request that costs n units of rule's limit.
+func (rl *RateLimiter) AllowN(ctx context.Context, rule Rule, key string, n int) (*Decision, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid cost %d", n)
+	}
+	return rl.allowN(ctx, rule, key, int64(n), true)
+}
+
+// Block blocks key under rule for duration seconds, as if it had exceeded the
+// rule's limit. A duration of zero or less blocks nothing.
+func (rl *RateLimiter) Block(ctx context.Context, rule Rule, key string, duration int) error {
+	return rl.storage.Block(ctx, rule.key(key), duration)
+}
+
+// AccessLists returns the allowlist and denylist checked by Check, CheckN and
+// PeekN.
+func (rl *RateLimiter) AccessLists() *AccessLists {
+	return rl.access
+}
+
+// Rule returns the named rule: "ip", "token" or one of Config.Rules.
+func (rl *RateLimiter) Rule(name string) (Rule, bool) {
+	switch name {
+	case "ip":
+		return rl.config.ipRule(), true
+	case "token":
+		return rl.config.tokenRule(), true
+	}
+	rule, exists := rl.config.Rules[name]
+	return rule, exists
+}
+
+func (rl *RateLimiter) allowN(ctx context.Context, rule Rule, id string, n int64, checkBlocked bool) (*Decision, error) {
+	decision, err := rl.enforce(ctx, rule, id, n, checkBlocked)
+	if err != nil || !rule.DryRun || !decision.Limited {
+		return decision, err
+	}
+	return rl.shadow(rule, id, decision), nil
+}
+
+// enforce counts a request for id under rule and decides it. Dry-run rules
+// are enforced too, against their own counters and blocks, so what they
+// report is what enforcing them would do.
+func (rl *RateLimiter) enforce(ctx context.Context, rule Rule, id string, n int64, checkBlocked bool) (*Decision, error) {
+	rule = rl.adapt(rule)
+	key := rule.key(id)
 
-		if count > int64(rl.config.TokenLimit) {
-			err = rl.storage.SetExpiration(ctx, fmt.Sprintf("token:%s:blocked", token), rl.config.TokenBlockDuration)
-			if err != nil {
-				return false, err
-			}
-			return true, nil
+	if checkBlocked {
+		blocked, err := rl.storage.IsBlocked(ctx, key)
+		if err != nil {
+			return nil, err
 		}
+		if blocked {
+			return rl.blockedDecision(ctx, rule, key)
+		}
+	}
 
-		return false, nil
+	if rule.Period != "" {
+		return rl.allowQuota(ctx, rule, id, n)
 	}
 
-	count, err := rl.storage.Increment(ctx, fmt.Sprintf("ip:%s", ip))
+	count, err := rl.add(ctx, rule, key, n)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	duration, err := rl.blockOver(ctx, rule, key, count, n)
+	if err != nil {
+		return nil, err
+	}
+	if count > int64(rule.Limit) {
+		return limitedDecision(rule, duration), nil
 	}
 
-	if count == 1 {
-		err = rl.storage.SetExpiration(ctx, fmt.Sprintf("ip:%s", ip), rl.config.IPBlockDuration)
+	return &Decision{
+		Limit:     rule.Limit,
+		Remaining: rule.Limit - int(count),
+	}, nil
+}
+
+// add counts n units for key, starting the window of rule when it creates
+// the counter.
+func (rl *RateLimiter) add(ctx context.Context, rule Rule, key string, n int64) (int64, error) {
+	var count int64
+	var err error
+	if n == 1 {
+		count, err = rl.storage.Increment(ctx, key)
+	} else {
+		count, err = rl.storage.IncrementBy(ctx, key, n)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The request that created the counter starts its window.
+	if count == n {
+		err = rl.storage.SetExpiration(ctx, key, rule.BlockDuration)
 		if err != nil {
-			return false, err
+			return 0, err
 		}
 	}
 
-	if count > int64(rl.config.IPLimit) {
-		err = rl.storage.SetExpiration(ctx, fmt.Sprintf("ip:%s:blocked", ip), rl.config.IPBlockDuration)
+	return count, nil
+}
+
+// accessDecision decides requests on an access list without counting them.
+func (rl *RateLimiter) accessDecision(ip string, token string) (*Decision, bool) {
+	list, listed := rl.access.match(ip, token)
+	switch {
+	case !listed:
+		return nil, false
+	case list == Denylist:
+		return &Decision{Limited: true, Denied: true}, true
+	default:
+		return &Decision{Allowlisted: true}, true
+	}
+}
+
+// blockOver blocks key once its count, after adding n, is over rule's limit,
+// and returns the block duration.
+//
+// For escalating rules only the request that went over the limit counts an
+// offense and blocks, so a burst of concurrent requests is a single offense
+// and cannot overwrite a longer block with a shorter one.
+func (rl *RateLimiter) blockOver(ctx context.Context, rule Rule, key string, count int64, n int64) (int, error) {
+	if count <= int64(rule.Limit) {
+		return 0, nil
+	}
+	if !rule.escalates() {
+		return rule.BlockDuration, rl.storage.Block(ctx, key, rule.BlockDuration)
+	}
+	if count-n > int64(rule.Limit) {
+		return rl.penalty(ctx, rule, key)
+	}
+
+	offensesKey := key + ":offenses"
+	offenses, err := rl.storage.Increment(ctx, offensesKey)
+	if err != nil {
+		return 0, err
+	}
+	duration := rule.blockDuration(offenses)
+	err = rl.storage.SetExpiration(ctx, offensesKey, duration+rule.penaltyWindow())
+	if err != nil {
+		return 0, err
+	}
+	return duration, rl.storage.Block(ctx, key, duration)
+}
+
+// penalty returns the duration of the current block of key under rule.
+func (rl *RateLimiter) penalty(ctx context.Context, rule Rule, key string) (int, error) {
+	if !rule.escalates() {
+		return rule.BlockDuration, nil
+	}
+	offenses, err := rl.storage.GetCounter(ctx, key+":offenses")
+	if err != nil {
+		return 0, err
+	}
+	return rule.blockDuration(offenses), nil
+}
+
+// blockedDecision limits a blocked key until its block ends. Blocks written by
+// Block or by another instance may not last rule's penalty, so the time left
+// is read from the storage when it can tell.
+func (rl *RateLimiter) blockedDecision(ctx context.Context, rule Rule, key string) (*Decision, error) {
+	duration, err := rl.remaining(ctx, key+":blocked")
+	if err != nil {
+		return nil, err
+	}
+	if duration == 0 {
+		duration, err = rl.penalty(ctx, rule, key)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		return true, nil
 	}
+	return limitedDecision(rule, duration), nil
+}
+
+// remaining returns the whole seconds left before key expires, or 0 when the
+// storage cannot tell.
+func (rl *RateLimiter) remaining(ctx context.Context, key string) (int, error) {
+	ttls, ok := rl.storage.(storage.TTLStorage)
+	if !ok {
+		return 0, nil
+	}
+	ttl, err := ttls.TTL(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Ceil(ttl.Seconds())), nil
+}
+
+func limitedDecision(rule Rule, retryAfter int) *Decision {
+	return &Decision{
+		Limited:    true,
+		Limit:      rule.Limit,
+		RetryAfter: retryAfter,
+		Global:     rule.Global,
+	}
+}
+
+// ipID normalizes ip for its key, aggregating it into its network when a
+// prefix is configured. IPv4-mapped IPv6 addresses count as IPv4.
+func (c *Config) ipID(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+
+	bits := c.IPv6Prefix
+	if addr.Is4() {
+		bits = c.IPv4Prefix
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
+// subject returns the rule and id a request is counted under: the token when
+// one is given, otherwise the IP.
+func (c *Config) subject(ip string, token string) (Rule, string) {
+	if token != "" {
+		return c.tokenRule(), token
+	}
+	return c.ipRule(), ip
+}
+
+func (c *Config) ipRule() Rule {
+	return Rule{
+		Name:             "ip",
+		Limit:            c.IPLimit,
+		BlockDuration:    c.IPBlockDuration,
+		MaxBlockDuration: c.IPMaxBlockDuration,
+		PenaltyWindow:    c.IPPenaltyWindow,
+	}
+}
+
+func (c *Config) tokenRule() Rule {
+	return Rule{
+		Name:             "token",
+		Limit:            c.TokenLimit,
+		BlockDuration:    c.TokenBlockDuration,
+		MaxBlockDuration: c.TokenMaxBlockDuration,
+		PenaltyWindow:    c.TokenPenaltyWindow,
+		Period:           c.TokenPeriod,
+		Location:         c.TokenLocation,
+	}
+}
+
+func (r Rule) escalates() bool {
+	return r.BlockDuration > 0 && r.MaxBlockDuration > r.BlockDuration
+}
+
+// blockDuration is the block of the given offense: BlockDuration doubled for
+// each earlier offense, capped at MaxBlockDuration.
+func (r Rule) blockDuration(offenses int64) int {
+	duration := r.BlockDuration
+	for i := int64(1); i < offenses && duration < r.MaxBlockDuration; i++ {
+		duration *= 2
+	}
+	return min(duration, r.MaxBlockDuration)
+}
+
+func (r Rule) penaltyWindow() int {
+	if r.PenaltyWindow > 0 {
+		return r.PenaltyWindow
+	}
+	return r.MaxBlockDuration
+}
 
-	return false, nil
+func (r Rule) key(id string) string {
+	return fmt.Sprintf("%s:%s", r.Name, id)
 }
@@ -3,9 +3,13 @@ package limiter
 import (
 	"context"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"rate-limiter/storage"
+
+	"github.com/alicebob/miniredis/v2"
 )
 
 func TestNewConfig(t *testing.T) {
@@ -13,8 +17,21 @@ func TestNewConfig(t *testing.T) {
 	os.Setenv("DEFAULT_IP_BLOCK_DURATION", "300")
 	os.Setenv("DEFAULT_TOKEN_LIMIT", "10")
 	os.Setenv("DEFAULT_TOKEN_BLOCK_DURATION", "300")
-
-	config := NewConfig()
+	os.Setenv("DEFAULT_IP_MAX_BLOCK_DURATION", "3600")
+	os.Setenv("DEFAULT_IP_PENALTY_WINDOW", "86400")
+	os.Setenv("DEFAULT_TOKEN_PERIOD", "month")
+	os.Setenv("ADAPTIVE_LATENCY_TARGET", "250ms")
+	os.Setenv("ADAPTIVE_ERROR_RATE", "0.05")
+	defer os.Unsetenv("ADAPTIVE_LATENCY_TARGET")
+	defer os.Unsetenv("ADAPTIVE_ERROR_RATE")
+	defer os.Unsetenv("DEFAULT_IP_MAX_BLOCK_DURATION")
+	defer os.Unsetenv("DEFAULT_IP_PENALTY_WINDOW")
+	defer os.Unsetenv("DEFAULT_TOKEN_PERIOD")
+
+	config, err := NewConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
 	if config.IPLimit == 0 {
 		t.Error("IPLimit should not be zero")
@@ -41,6 +58,52 @@ func TestNewConfig(t *testing.T) {
 	if config.TokenBlockDuration != 300 {
 		t.Errorf("Expected TokenBlockDuration 300, got %d", config.TokenBlockDuration)
 	}
+	if rule := config.ipRule(); rule.MaxBlockDuration != 3600 || rule.PenaltyWindow != 86400 {
+		t.Errorf("Expected the IP rule to escalate, got %+v", rule)
+	}
+	if config.TokenPeriod != PeriodMonth {
+		t.Errorf("Expected TokenPeriod month, got %q", config.TokenPeriod)
+	}
+	if config.AdaptiveLatency != 250*time.Millisecond || config.AdaptiveErrorRate != 0.05 {
+		t.Errorf("Expected adaptive targets 250ms and 0.05, got %v and %v", config.AdaptiveLatency, config.AdaptiveErrorRate)
+	}
+}
+
+func TestNewConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{"DEFAULT_IP_LIMIT", "five"},
+		{"DEFAULT_TOKEN_PERIOD", "year"},
+		{"DEFAULT_TOKEN_TIMEZONE", "Nowhere/City"},
+		{"RATE_LIMIT_RULES", "search:limit=ten"},
+		{"RATE_LIMIT_ROUTE_COSTS", "/export"},
+		{"ALLOWLIST", "not-an-ip"},
+		{"DENYLIST", "10.0.0.0/99"},
+		{"CONCURRENCY_LIMIT", "many"},
+		{"CONCURRENCY_LEASE", "30"},
+		{"ADAPTIVE_LATENCY_TARGET", "fast"},
+		{"ADAPTIVE_ERROR_RATE", "5%"},
+		{"ADAPTIVE_INTERVAL", "5"},
+		{"PRIORITY_CLASSES", "anonymous=2"},
+		{"PRIORITY_ROUTES", "/health"},
+		{"PRIORITY_PLANS", "key-1"},
+	}
+
+	for _, tt := range tests {
+		t.Setenv(tt.key, tt.value)
+		if _, err := NewConfig(); err == nil || !strings.Contains(err.Error(), tt.key) {
+			t.Errorf("Expected an error naming %s=%q, got %v", tt.key, tt.value, err)
+		}
+		os.Unsetenv(tt.key)
+	}
+
+	t.Setenv("ADAPTIVE_MIN_SCALE", "0.8")
+	t.Setenv("ADAPTIVE_MAX_SCALE", "0.5")
+	if _, err := NewConfig(); err == nil {
+		t.Error("Expected an error for a minimum scale over the maximum")
+	}
 }
 
 func TestNewRateLimiter(t *testing.T) {
@@ -256,12 +319,290 @@ func TestCheckRateLimit_StorageError(t *testing.T) {
 	}
 }
 
+func TestAllowN_Cost(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	rateLimiter := NewRateLimiter(mockStorage, &Config{})
+	rule := Rule{Name: "export", Limit: 10, BlockDuration: 60}
+	ctx := context.Background()
+
+	decision, err := rateLimiter.AllowN(ctx, rule, "user-1", 4)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decision.Limited || decision.Remaining != 6 {
+		t.Errorf("Expected 6 remaining, got %+v", decision)
+	}
+
+	decision, _ = rateLimiter.AllowN(ctx, rule, "user-1", 6)
+	if decision.Limited || decision.Remaining != 0 {
+		t.Errorf("Expected 0 remaining, got %+v", decision)
+	}
+
+	decision, _ = rateLimiter.AllowN(ctx, rule, "user-1", 1)
+	if !decision.Limited {
+		t.Error("Request over the limit should be limited")
+	}
+
+	if _, err := rateLimiter.AllowN(ctx, rule, "user-2", 0); err == nil {
+		t.Error("Expected error for zero cost")
+	}
+}
+
+func TestAllow_ProgressivePenalty(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	rateLimiter := NewRateLimiter(mockStorage, &Config{})
+	rule := Rule{Name: "login", Limit: 1, BlockDuration: 10, MaxBlockDuration: 60, PenaltyWindow: 3600}
+	ctx := context.Background()
+
+	for i, expected := range []int{10, 20, 40, 60, 60} {
+		rateLimiter.Allow(ctx, rule, "user-1")
+		decision, _ := rateLimiter.Allow(ctx, rule, "user-1")
+		if !decision.Limited || decision.RetryAfter != expected {
+			t.Errorf("Offense %d: expected a %ds block, got %+v", i+1, expected, decision)
+		}
+		decision, _ = rateLimiter.Allow(ctx, rule, "user-1")
+		if !decision.Limited || decision.RetryAfter != expected {
+			t.Errorf("Offense %d: expected blocked requests to report %ds, got %+v", i+1, expected, decision)
+		}
+
+		// The block and the window expire.
+		mockStorage.SetBlocked("login:user-1", false)
+		count, _ := mockStorage.GetCounter(ctx, "login:user-1")
+		mockStorage.IncrementBy(ctx, "login:user-1", -count)
+	}
+
+	// The offenses expire after the penalty window.
+	offenses, _ := mockStorage.GetCounter(ctx, "login:user-1:offenses")
+	if offenses != 5 {
+		t.Errorf("Expected 5 offenses, got %d", offenses)
+	}
+	mockStorage.IncrementBy(ctx, "login:user-1:offenses", -offenses)
+	rateLimiter.Allow(ctx, rule, "user-1")
+	if decision, _ := rateLimiter.Allow(ctx, rule, "user-1"); decision.RetryAfter != 10 {
+		t.Errorf("Expected the block to start over, got %+v", decision)
+	}
+}
+
+func TestAllow_ProgressivePenaltyBurst(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	rateLimiter := NewRateLimiter(mockStorage, &Config{})
+	rule := Rule{Name: "login", Limit: 2, BlockDuration: 10, MaxBlockDuration: 60}
+	ctx := context.Background()
+
+	// Requests over the limit that raced the block are a single offense.
+	for i := 0; i < 5; i++ {
+		rateLimiter.allowN(ctx, rule, "user-1", 1, false)
+	}
+	if offenses, _ := mockStorage.GetCounter(ctx, "login:user-1:offenses"); offenses != 1 {
+		t.Errorf("Expected 1 offense, got %d", offenses)
+	}
+}
+
+func TestRule_BlockDuration(t *testing.T) {
+	rule := Rule{BlockDuration: 30, MaxBlockDuration: 100}
+	for offenses, expected := range map[int64]int{1: 30, 2: 60, 3: 100, 10: 100} {
+		if got := rule.blockDuration(offenses); got != expected {
+			t.Errorf("blockDuration(%d): expected %d, got %d", offenses, expected, got)
+		}
+	}
+
+	if rule.penaltyWindow() != 100 {
+		t.Errorf("Expected penalty window to default to MaxBlockDuration, got %d", rule.penaltyWindow())
+	}
+	if (Rule{BlockDuration: 30}).escalates() || (Rule{MaxBlockDuration: 30}).escalates() {
+		t.Error("Expected rules without a greater MaxBlockDuration not to escalate")
+	}
+}
+
+func TestCheckN_Cost(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{IPLimit: 10, IPBlockDuration: 300, TokenLimit: 20, TokenBlockDuration: 300}
+	rateLimiter := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	decision, err := rateLimiter.CheckN(ctx, "192.168.1.1", "", 6)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decision.Remaining != 4 {
+		t.Errorf("Expected 4 remaining, got %+v", decision)
+	}
+
+	decision, _ = rateLimiter.CheckN(ctx, "192.168.1.1", "", 6)
+	if !decision.Limited {
+		t.Error("Request costing more than the remaining limit should be limited")
+	}
+
+	decision, _ = rateLimiter.CheckN(ctx, "192.168.1.2", "test-token", 15)
+	if decision.Limited || decision.Remaining != 5 {
+		t.Errorf("Token cost should use the token limit, got %+v", decision)
+	}
+
+	if _, err := rateLimiter.CheckN(ctx, "192.168.1.3", "", 0); err == nil {
+		t.Error("Expected error for zero cost")
+	}
+}
+
+func TestCheck_BlockCacheSkipsRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	redisStorage, err := storage.NewRedisStorageWithOptions(storage.RedisOptions{
+		Addrs:          []string{server.Addr()},
+		BlockCacheSize: 100,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer redisStorage.Close()
+	config := &Config{IPLimit: 1, IPBlockDuration: 300, TokenLimit: 10, TokenBlockDuration: 300}
+	rateLimiter := NewRateLimiter(redisStorage, config)
+	ctx := context.Background()
+
+	rateLimiter.Check(ctx, "192.168.1.1", "")
+	if decision, _ := rateLimiter.Check(ctx, "192.168.1.1", ""); !decision.Limited {
+		t.Fatal("Expected the IP to be blocked")
+	}
+
+	commands := server.CommandCount()
+	for i := 0; i < 3; i++ {
+		decision, err := rateLimiter.Check(ctx, "192.168.1.1", "")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !decision.Limited || decision.RetryAfter <= 0 || decision.RetryAfter > 300 {
+			t.Errorf("Request %d: expected a blocked decision with the remaining time, got %+v", i+1, decision)
+		}
+	}
+	if sent := server.CommandCount() - commands; sent != 0 {
+		t.Errorf("Expected blocked requests to be answered from the block cache, got %d Redis commands", sent)
+	}
+}
+
+func TestPeekAndRecordN(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{IPLimit: 2, IPBlockDuration: 300, TokenLimit: 10, TokenBlockDuration: 300}
+	rateLimiter := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	decision, err := rateLimiter.PeekN(ctx, "192.168.1.1", "", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decision.Limited || decision.Remaining != 2 {
+		t.Errorf("Unexpected decision: %+v", decision)
+	}
+	if count, _ := mockStorage.GetCounter(ctx, "ip:192.168.1.1"); count != 0 {
+		t.Errorf("PeekN should not count, got count %d", count)
+	}
+
+	rateLimiter.RecordN(ctx, "192.168.1.1", "", 2)
+	mockStorage.SetExpiration(ctx, "ip:192.168.1.1", 42)
+	if decision, _ := rateLimiter.PeekN(ctx, "192.168.1.1", "", 1); !decision.Limited || decision.RetryAfter != 42 {
+		t.Errorf("Request over the remaining limit should be limited until the window ends, got %+v", decision)
+	}
+
+	rateLimiter.RecordN(ctx, "192.168.1.1", "", -1)
+	if count, _ := mockStorage.GetCounter(ctx, "ip:192.168.1.1"); count != 1 {
+		t.Errorf("Expected the refund to be applied, got count %d", count)
+	}
+
+	rateLimiter.RecordN(ctx, "192.168.1.1", "", 2)
+	if blocked, _ := mockStorage.IsBlocked(ctx, "ip:192.168.1.1"); !blocked {
+		t.Error("Recording over the limit should block")
+	}
+
+	// Refunds never leave a negative counter behind.
+	rateLimiter.RecordN(ctx, "192.168.1.2", "test-token", -3)
+	if count, _ := mockStorage.GetCounter(ctx, "token:test-token"); count != 0 {
+		t.Errorf("Expected count 0, got %d", count)
+	}
+}
+
+func TestConfig_IPID(t *testing.T) {
+	config := &Config{IPv4Prefix: 24, IPv6Prefix: 64}
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"192.168.1.77", "192.168.1.0/24"},
+		{"::ffff:192.168.1.77", "192.168.1.0/24"},
+		{"2001:db8:1:2:aaaa::1", "2001:db8:1:2::/64"},
+		{"2001:0db8:0001:0002:ffff:ffff:ffff:ffff", "2001:db8:1:2::/64"},
+		{"fe80::1%eth0", "fe80::/64"},
+		{"invalid", "invalid"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if id := config.ipID(tt.ip); id != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.ip, tt.expected, id)
+		}
+	}
+
+	// Without prefixes addresses are only normalized.
+	config = &Config{}
+	if id := config.ipID("::ffff:10.0.0.1"); id != "10.0.0.1" {
+		t.Errorf("Expected IPv4-mapped address to be unmapped, got %q", id)
+	}
+	if id := config.ipID("2001:0db8::0001"); id != "2001:db8::1" {
+		t.Errorf("Expected canonical IPv6 address, got %q", id)
+	}
+}
+
+func TestCheck_IPv6Prefix(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{IPLimit: 2, IPBlockDuration: 300, IPv6Prefix: 64}
+	rateLimiter := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	rateLimiter.Check(ctx, "2001:db8::1", "")
+	rateLimiter.Check(ctx, "2001:db8::2", "")
+	decision, _ := rateLimiter.Check(ctx, "2001:db8::3", "")
+	if !decision.Limited {
+		t.Error("Rotating addresses within the /64 should not escape the limit")
+	}
+	if blocked, _ := mockStorage.IsBlocked(ctx, "ip:2001:db8::/64"); !blocked {
+		t.Error("Expected the /64 to be blocked")
+	}
+
+	if decision, _ := rateLimiter.Check(ctx, "2001:db8:0:1::1", ""); decision.Limited {
+		t.Error("Other networks should not be limited")
+	}
+}
+
+func TestRateLimiter_Rule(t *testing.T) {
+	config := &Config{
+		IPLimit:            5,
+		IPBlockDuration:    300,
+		TokenLimit:         10,
+		TokenBlockDuration: 60,
+		Rules:              map[string]Rule{"search": {Name: "search", Limit: 100, BlockDuration: 30}},
+	}
+	rateLimiter := NewRateLimiter(storage.NewMockStorage(), config)
+
+	if rule, _ := rateLimiter.Rule("ip"); rule.Limit != 5 || rule.BlockDuration != 300 {
+		t.Errorf("Unexpected ip rule: %+v", rule)
+	}
+	if rule, _ := rateLimiter.Rule("token"); rule.Limit != 10 || rule.BlockDuration != 60 {
+		t.Errorf("Unexpected token rule: %+v", rule)
+	}
+	if rule, exists := rateLimiter.Rule("search"); !exists || rule.Limit != 100 {
+		t.Errorf("Unexpected search rule: %+v", rule)
+	}
+	if _, exists := rateLimiter.Rule("missing"); exists {
+		t.Error("Unknown rule should not exist")
+	}
+}
+
 type errorStorage struct{}
 
 func (e *errorStorage) Increment(ctx context.Context, key string) (int64, error) {
 	return 0, context.DeadlineExceeded
 }
 
+func (e *errorStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	return 0, context.DeadlineExceeded
+}
+
 func (e *errorStorage) SetExpiration(ctx context.Context, key string, duration int) error {
 	return context.DeadlineExceeded
 }
@@ -274,6 +615,10 @@ func (e *errorStorage) IsBlocked(ctx context.Context, key string) (bool, error)
 	return false, context.DeadlineExceeded
 }
 
+func (e *errorStorage) Block(ctx context.Context, key string, duration int) error {
+	return context.DeadlineExceeded
+}
+
 func TestCheckRateLimit_EdgeCases(t *testing.T) {
 	mockStorage := storage.NewMockStorage()
 	config := &Config{
@@ -310,3 +655,88 @@ func TestCheckRateLimit_EdgeCases(t *testing.T) {
 		t.Error("Second request should be limited")
 	}
 }
+
+func TestCheckRateLimit_BlocksAfterLimit(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{
+		IPLimit:            1,
+		IPBlockDuration:    120,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+	}
+
+	limiter := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	limiter.CheckRateLimit(ctx, "192.168.1.1", "")
+	limited, _ := limiter.CheckRateLimit(ctx, "192.168.1.1", "")
+	if !limited {
+		t.Fatal("Second request should be limited")
+	}
+
+	blocked, _ := mockStorage.IsBlocked(ctx, "ip:192.168.1.1")
+	if !blocked {
+		t.Error("IP should be blocked after exceeding the limit")
+	}
+}
+
+func TestCheck_Decision(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{
+		IPLimit:            2,
+		IPBlockDuration:    120,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+	}
+
+	limiter := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	decision, err := limiter.Check(ctx, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decision.Limited || decision.Limit != 2 || decision.Remaining != 1 {
+		t.Errorf("Unexpected first decision %+v", decision)
+	}
+
+	decision, _ = limiter.Check(ctx, "192.168.1.1", "")
+	if decision.Limited || decision.Remaining != 0 {
+		t.Errorf("Unexpected second decision %+v", decision)
+	}
+
+	decision, _ = limiter.Check(ctx, "192.168.1.1", "")
+	if !decision.Limited || decision.RetryAfter != 120 {
+		t.Errorf("Unexpected third decision %+v", decision)
+	}
+
+	decision, _ = limiter.Check(ctx, "192.168.1.1", "test-token")
+	if !decision.Limited || decision.Limit != 2 {
+		t.Errorf("Blocked IP should be limited even with a token, got %+v", decision)
+	}
+}
+
+func TestAllow_Rule(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	limiter := NewRateLimiter(mockStorage, &Config{})
+	ctx := context.Background()
+	rule := Rule{Name: "method", Limit: 1, BlockDuration: 60}
+
+	decision, err := limiter.Allow(ctx, rule, "/test.Service/Get")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decision.Limited {
+		t.Error("First request should not be limited")
+	}
+
+	decision, _ = limiter.Allow(ctx, rule, "/test.Service/Get")
+	if !decision.Limited || decision.RetryAfter != 60 {
+		t.Errorf("Second request should be limited, got %+v", decision)
+	}
+
+	blocked, _ := mockStorage.IsBlocked(ctx, "method:/test.Service/Get")
+	if !blocked {
+		t.Error("Rule key should be blocked")
+	}
+}
@@ -0,0 +1,181 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LoadShedMessage is the error message returned to requests shed under load.
+const LoadShedMessage = "the service is overloaded, please try again later"
+
+// shedKey counts the requests admitted in the current second across
+// instances.
+const shedKey = "shed:load"
+
+// PriorityClass sheds its requests once the load reaches ShedAt of the shed
+// capacity. A ShedAt of 0 never sheds them.
+type PriorityClass struct {
+	Name   string
+	ShedAt float64
+}
+
+// PriorityRoute gives the requests matching Route the priority Class.
+type PriorityRoute struct {
+	Route Route
+	Class string
+}
+
+// ParsePriorityClasses parses priority classes in the PRIORITY_CLASSES
+// format, from the lowest priority to the highest:
+//
+//	anonymous=0.6,free=0.8,enterprise=0
+func ParsePriorityClasses(value string) ([]PriorityClass, error) {
+	var classes []PriorityClass
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, shedAt, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid priority class %q: expected <name>=<shed_at>", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate priority class %q", name)
+		}
+		fraction, err := strconv.ParseFloat(strings.TrimSpace(shedAt), 64)
+		if err != nil || fraction < 0 || fraction > 1 {
+			return nil, fmt.Errorf("invalid priority class %q: shed_at must be between 0 and 1", entry)
+		}
+
+		seen[name] = true
+		classes = append(classes, PriorityClass{Name: name, ShedAt: fraction})
+	}
+
+	return classes, nil
+}
+
+// ParsePriorityRoutes parses priority routes in the PRIORITY_ROUTES format:
+//
+//	/health*=enterprise;POST /export=anonymous
+func ParsePriorityRoutes(value string) ([]PriorityRoute, error) {
+	var routes []PriorityRoute
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, "=")
+		if i < 0 || strings.TrimSpace(entry[i+1:]) == "" {
+			return nil, fmt.Errorf("invalid priority route %q: expected [METHOD] <path>=<class>", entry)
+		}
+		route, err := ParseRoute(entry[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority route %q: %v", entry, err)
+		}
+
+		routes = append(routes, PriorityRoute{Route: route, Class: strings.TrimSpace(entry[i+1:])})
+	}
+
+	return routes, nil
+}
+
+// ParsePriorityPlans parses the plans of API keys in the PRIORITY_PLANS
+// format:
+//
+//	key-1=enterprise,key-2=free
+func ParsePriorityPlans(value string) (map[string]string, error) {
+	plans := make(map[string]string)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, class, found := strings.Cut(entry, "=")
+		key, class = strings.TrimSpace(key), strings.TrimSpace(class)
+		if !found || key == "" || class == "" {
+			return nil, fmt.Errorf("invalid priority plan %q: expected <API key>=<class>", entry)
+		}
+		plans[key] = class
+	}
+
+	return plans, nil
+}
+
+// Priority returns the priority class of a request: the class of the first
+// priority route matching it, then the plan of its API key, then
+// AnonymousPriority without an API key or DefaultPriority with one.
+func (rl *RateLimiter) Priority(method, path, token string) string {
+	for _, route := range rl.config.PriorityRoutes {
+		if route.Route.matches(method, path) {
+			return route.Class
+		}
+	}
+	if class, exists := rl.config.PriorityPlans[token]; token != "" && exists {
+		return class
+	}
+	if token == "" {
+		return rl.config.AnonymousPriority
+	}
+	return rl.config.DefaultPriority
+}
+
+// Shed counts a request of the priority class from ip, or from token when one
+// is given, against the ShedCapacity shared by every instance, and sheds it
+// when the requests admitted in the current second reached the share of the
+// capacity open to its class. Shed requests are not counted, so they do not
+// take capacity from higher priorities. Requests of unknown classes are shed
+// with the first class, and requests on the access lists are never shed nor
+// counted.
+//
+// Shed is meant to run last, once the limits admitted the request, so that
+// clients already rejected by them do not use up the capacity.
+func (rl *RateLimiter) Shed(ctx context.Context, ip string, token string, class string) (*Decision, error) {
+	capacity := rl.config.ShedCapacity
+	if capacity <= 0 || len(rl.config.PriorityClasses) == 0 {
+		return &Decision{}, nil
+	}
+	if decision, listed := rl.accessDecision(ip, token); listed {
+		return decision, nil
+	}
+	priority := rl.config.priorityClass(class)
+
+	count, err := rl.storage.Increment(ctx, shedKey)
+	if err != nil {
+		return nil, err
+	}
+	if count == 1 {
+		if err := rl.storage.SetExpiration(ctx, shedKey, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	// A share rounding down to nothing would shed the class even when idle.
+	threshold := max(int(priority.ShedAt*float64(capacity)), 1)
+	if priority.ShedAt == 0 || count <= int64(threshold) {
+		return &Decision{Limit: capacity}, nil
+	}
+	if _, err := rl.storage.IncrementBy(ctx, shedKey, -1); err != nil {
+		return nil, err
+	}
+	return &Decision{Limited: true, Shed: true, Limit: threshold, RetryAfter: 1}, nil
+}
+
+func (c *Config) priorityClass(name string) PriorityClass {
+	for _, class := range c.PriorityClasses {
+		if class.Name == name {
+			return class
+		}
+	}
+	return c.PriorityClasses[0]
+}
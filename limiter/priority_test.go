@@ -0,0 +1,162 @@
+package limiter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"rate-limiter/storage"
+)
+
+func TestParsePriorityClasses(t *testing.T) {
+	classes, err := ParsePriorityClasses(" anonymous=0.6, free = 0.8 ,enterprise=0,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []PriorityClass{
+		{Name: "anonymous", ShedAt: 0.6},
+		{Name: "free", ShedAt: 0.8},
+		{Name: "enterprise", ShedAt: 0},
+	}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, classes)
+	}
+
+	for _, value := range []string{"free", "=0.5", "free=abc", "free=1.5", "free=-0.1", "free=0.5,free=0.6"} {
+		if _, err := ParsePriorityClasses(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestParsePriorityRoutesAndPlans(t *testing.T) {
+	routes, err := ParsePriorityRoutes("/health*=enterprise; post /export=anonymous")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []PriorityRoute{
+		{Route: Route{Path: "/health*"}, Class: "enterprise"},
+		{Route: Route{Method: "POST", Path: "/export"}, Class: "anonymous"},
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, routes)
+	}
+
+	plans, err := ParsePriorityPlans("key-1=enterprise, key-2=free")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(plans, map[string]string{"key-1": "enterprise", "key-2": "free"}) {
+		t.Errorf("Unexpected plans %v", plans)
+	}
+
+	for _, value := range []string{"/health", "/health=", "health=free"} {
+		if _, err := ParsePriorityRoutes(value); err == nil {
+			t.Errorf("Expected error for route %q", value)
+		}
+	}
+	for _, value := range []string{"key-1", "=free", "key-1="} {
+		if _, err := ParsePriorityPlans(value); err == nil {
+			t.Errorf("Expected error for plan %q", value)
+		}
+	}
+}
+
+func TestRateLimiter_Priority(t *testing.T) {
+	config := &Config{
+		PriorityRoutes:    []PriorityRoute{{Route: Route{Path: "/health"}, Class: "enterprise"}},
+		PriorityPlans:     map[string]string{"key-1": "enterprise"},
+		AnonymousPriority: "anonymous",
+		DefaultPriority:   "free",
+	}
+	rl := NewRateLimiter(storage.NewMockStorage(), config)
+
+	tests := []struct {
+		path     string
+		token    string
+		expected string
+	}{
+		{"/health", "", "enterprise"},
+		{"/test", "key-1", "enterprise"},
+		{"/test", "key-2", "free"},
+		{"/test", "", "anonymous"},
+	}
+	for _, tt := range tests {
+		if class := rl.Priority("GET", tt.path, tt.token); class != tt.expected {
+			t.Errorf("Priority(%s, %q): expected %q, got %q", tt.path, tt.token, tt.expected, class)
+		}
+	}
+}
+
+func TestShed(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{
+		ShedCapacity: 10,
+		PriorityClasses: []PriorityClass{
+			{Name: "anonymous", ShedAt: 0.5},
+			{Name: "free", ShedAt: 0.8},
+			{Name: "enterprise"},
+		},
+		Allowlist: []string{"10.0.0.1"},
+	}
+	rl := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	shed := func(class string) bool {
+		decision, err := rl.Shed(ctx, "192.168.1.1", "", class)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return decision.Shed
+	}
+
+	for i := 0; i < 5; i++ {
+		if shed("anonymous") {
+			t.Errorf("Request %d: expected anonymous traffic to pass under half the capacity", i+1)
+		}
+	}
+	if !shed("anonymous") || !shed("unknown") {
+		t.Error("Expected anonymous and unknown traffic to be shed first")
+	}
+	for i := 0; i < 3; i++ {
+		if shed("free") {
+			t.Errorf("Request %d: expected free traffic to pass under 80%% of the capacity", i+1)
+		}
+	}
+	if !shed("free") {
+		t.Error("Expected free traffic to be shed next")
+	}
+	for i := 0; i < 5; i++ {
+		if shed("enterprise") {
+			t.Errorf("Request %d: expected enterprise traffic never to be shed", i+1)
+		}
+	}
+	if decision, _ := rl.Shed(ctx, "10.0.0.1", "", "anonymous"); decision.Shed || !decision.Allowlisted {
+		t.Errorf("Expected allowlisted traffic never to be shed, got %+v", decision)
+	}
+	if count, _ := mockStorage.GetCounter(ctx, shedKey); count != 13 {
+		t.Errorf("Expected only admitted requests to be counted, got %d", count)
+	}
+
+	disabled := NewRateLimiter(mockStorage, &Config{PriorityClasses: config.PriorityClasses})
+	if shed, _ := disabled.Shed(ctx, "192.168.1.1", "", "anonymous"); shed.Shed {
+		t.Error("Expected no shedding without a capacity")
+	}
+}
+
+func TestShed_SmallShare(t *testing.T) {
+	config := &Config{
+		ShedCapacity:    1,
+		PriorityClasses: []PriorityClass{{Name: "anonymous", ShedAt: 0.5}},
+	}
+	rl := NewRateLimiter(storage.NewMockStorage(), config)
+	ctx := context.Background()
+
+	if decision, _ := rl.Shed(ctx, "192.168.1.1", "", "anonymous"); decision.Shed {
+		t.Error("Expected a share rounding down to zero to still admit a request")
+	}
+	if decision, _ := rl.Shed(ctx, "192.168.1.1", "", "anonymous"); !decision.Shed || decision.Limit != 1 {
+		t.Errorf("Expected the second request to be shed at a threshold of 1, got %+v", decision)
+	}
+}
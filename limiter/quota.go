@@ -0,0 +1,153 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Period aligns the windows of a rule to the calendar.
+type Period string
+
+const (
+	// PeriodDay windows start at midnight.
+	PeriodDay Period = "day"
+	// PeriodMonth windows start at midnight on the 1st.
+	PeriodMonth Period = "month"
+)
+
+// ParsePeriod parses a period: "day", "month", or "" for none.
+func ParsePeriod(value string) (Period, error) {
+	switch period := Period(value); period {
+	case "", PeriodDay, PeriodMonth:
+		return period, nil
+	}
+	return "", fmt.Errorf("invalid period %q: expected day or month", value)
+}
+
+// quotaGrace keeps a period's counter a little past its end, so instances
+// whose clocks lag still find it.
+const quotaGrace = time.Hour
+
+// Usage is how much of a quota a key has used in the current period.
+type Usage struct {
+	Rule      string    `json:"rule"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+// Quotas returns the token rule when it has a calendar Period, then the named
+// rules that have one, sorted by name.
+func (rl *RateLimiter) Quotas() []Rule {
+	var quotas []Rule
+	for _, rule := range rl.config.Rules {
+		if rule.Period != "" {
+			quotas = append(quotas, rule)
+		}
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Name < quotas[j].Name })
+	if tokenRule := rl.config.tokenRule(); tokenRule.Period != "" {
+		quotas = append([]Rule{tokenRule}, quotas...)
+	}
+	return quotas
+}
+
+// Usage returns the usage of key under the quota rule in the current period.
+func (rl *RateLimiter) Usage(ctx context.Context, rule Rule, key string) (*Usage, error) {
+	if rule.Period == "" {
+		return nil, fmt.Errorf("rule %q has no period", rule.Name)
+	}
+	counter, resetAt := rl.counter(rule, key)
+	used, err := rl.storage.GetCounter(ctx, counter)
+	if err != nil {
+		return nil, err
+	}
+	return &Usage{
+		Rule:      rule.Name,
+		Limit:     rule.Limit,
+		Used:      int(used),
+		Remaining: max(rule.Limit-int(used), 0),
+		ResetAt:   resetAt,
+	}, nil
+}
+
+// allowQuota counts a request against a calendar quota. Requests over the
+// quota are not counted, so the usage never goes past the limit; they are
+// limited until the period resets rather than blocked.
+//
+// The refund is a separate command, so a request arriving between the
+// increment and the refund of another sees the usage inflated: near the limit
+// two concurrent requests can both be rejected even though one of them would
+// have fit. Both are told to retry after the reset, which errs on the side of
+// the quota.
+func (rl *RateLimiter) allowQuota(ctx context.Context, rule Rule, id string, n int64) (*Decision, error) {
+	counter, resetAt := rl.counter(rule, id)
+	count, err := rl.addQuota(ctx, counter, resetAt, n)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > int64(rule.Limit) {
+		if _, err := rl.storage.IncrementBy(ctx, counter, -n); err != nil {
+			return nil, err
+		}
+		return rl.quotaExceeded(rule, count-n, resetAt), nil
+	}
+
+	return &Decision{
+		Limit:     rule.Limit,
+		Remaining: rule.Limit - int(count),
+	}, nil
+}
+
+// addQuota counts n units in the counter of a period ending at resetAt.
+func (rl *RateLimiter) addQuota(ctx context.Context, counter string, resetAt time.Time, n int64) (int64, error) {
+	count, err := rl.storage.IncrementBy(ctx, counter, n)
+	if err != nil {
+		return 0, err
+	}
+	if count == n {
+		ttl := resetAt.Add(quotaGrace).Sub(rl.now())
+		if err := rl.storage.SetExpiration(ctx, counter, int(ttl/time.Second)); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+func (rl *RateLimiter) quotaExceeded(rule Rule, used int64, resetAt time.Time) *Decision {
+	decision := limitedDecision(rule, int(math.Ceil(resetAt.Sub(rl.now()).Seconds())))
+	decision.Remaining = max(rule.Limit-int(used), 0)
+	return decision
+}
+
+// counter returns the key counting id under rule and, for calendar quotas,
+// when it resets.
+func (rl *RateLimiter) counter(rule Rule, id string) (string, time.Time) {
+	if rule.Period == "" {
+		return rule.key(id), time.Time{}
+	}
+	start, end := rule.periodBounds(rl.now())
+	return rule.key(id) + ":" + start.Format("2006-01-02"), end
+}
+
+// periodBounds returns the calendar period containing t in the rule's
+// location, UTC by default.
+func (r Rule) periodBounds(t time.Time) (time.Time, time.Time) {
+	location := r.Location
+	if location == nil {
+		location = time.UTC
+	}
+	year, month, day := t.In(location).Date()
+
+	if r.Period == PeriodMonth {
+		start := time.Date(year, month, 1, 0, 0, 0, 0, location)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(year, month, day, 0, 0, 0, 0, location)
+	return start, start.AddDate(0, 0, 1)
+}
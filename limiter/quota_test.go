@@ -0,0 +1,142 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+func TestRule_PeriodBounds(t *testing.T) {
+	saoPaulo := time.FixedZone("-03", -3*3600)
+	tests := []struct {
+		rule  Rule
+		now   time.Time
+		start time.Time
+		end   time.Time
+	}{
+		{
+			Rule{Period: PeriodMonth},
+			time.Date(2026, 10, 19, 15, 4, 5, 0, time.UTC),
+			time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Rule{Period: PeriodMonth},
+			time.Date(2026, 12, 31, 23, 59, 59, 0, time.UTC),
+			time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Rule{Period: PeriodDay},
+			time.Date(2026, 10, 19, 15, 4, 5, 0, time.UTC),
+			time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// 01:00 UTC on the 1st is still the previous month in São Paulo.
+			Rule{Period: PeriodMonth, Location: saoPaulo},
+			time.Date(2026, 11, 1, 1, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 1, 0, 0, 0, 0, saoPaulo),
+			time.Date(2026, 11, 1, 0, 0, 0, 0, saoPaulo),
+		},
+	}
+
+	for _, tt := range tests {
+		start, end := tt.rule.periodBounds(tt.now)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("periodBounds(%v): expected %v - %v, got %v - %v", tt.now, tt.start, tt.end, start, end)
+		}
+	}
+}
+
+func TestAllow_Quota(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	rateLimiter := NewRateLimiter(mockStorage, &Config{})
+	now := time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)
+	rateLimiter.now = func() time.Time { return now }
+	rule := Rule{Name: "api", Limit: 3, Period: PeriodMonth}
+	ctx := context.Background()
+
+	rateLimiter.AllowN(ctx, rule, "key-1", 2)
+	decision, _ := rateLimiter.Allow(ctx, rule, "key-1")
+	if decision.Limited || decision.Remaining != 0 {
+		t.Errorf("Expected the last unit of the quota, got %+v", decision)
+	}
+
+	decision, _ = rateLimiter.Allow(ctx, rule, "key-1")
+	if !decision.Limited || decision.RetryAfter != 3600 {
+		t.Errorf("Expected limited until the 1st, got %+v", decision)
+	}
+	if count, _ := mockStorage.GetCounter(ctx, "api:key-1:2026-10-01"); count != 3 {
+		t.Errorf("Expected requests over the quota not to be counted, got %d", count)
+	}
+
+	now = now.Add(time.Hour)
+	decision, _ = rateLimiter.Allow(ctx, rule, "key-1")
+	if decision.Limited || decision.Remaining != 2 {
+		t.Errorf("Expected the quota to reset on the 1st, got %+v", decision)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{
+		Rules: map[string]Rule{
+			"monthly": {Name: "monthly", Limit: 100, Period: PeriodMonth},
+			"daily":   {Name: "daily", Limit: 10, Period: PeriodDay},
+			"search":  {Name: "search", Limit: 5, BlockDuration: 60},
+		},
+	}
+	rateLimiter := NewRateLimiter(mockStorage, config)
+	rateLimiter.now = func() time.Time { return time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC) }
+	ctx := context.Background()
+
+	quotas := rateLimiter.Quotas()
+	if len(quotas) != 2 || quotas[0].Name != "daily" || quotas[1].Name != "monthly" {
+		t.Fatalf("Expected the daily and monthly quotas, got %+v", quotas)
+	}
+
+	rateLimiter.AllowN(ctx, config.Rules["monthly"], "key-1", 40)
+	usage, err := rateLimiter.Usage(ctx, config.Rules["monthly"], "key-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := Usage{Rule: "monthly", Limit: 100, Used: 40, Remaining: 60, ResetAt: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)}
+	if *usage != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *usage)
+	}
+
+	if _, err := rateLimiter.Usage(ctx, config.Rules["search"], "key-1"); err == nil {
+		t.Error("Expected error for a rule without period")
+	}
+}
+
+func TestCheck_TokenQuota(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{IPLimit: 100, IPBlockDuration: 60, TokenLimit: 5, TokenPeriod: PeriodDay}
+	rateLimiter := NewRateLimiter(mockStorage, config)
+	rateLimiter.now = func() time.Time { return time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC) }
+	ctx := context.Background()
+
+	if quotas := rateLimiter.Quotas(); len(quotas) != 1 || quotas[0].Name != "token" {
+		t.Errorf("Expected the token quota, got %+v", quotas)
+	}
+
+	rateLimiter.CheckN(ctx, "192.168.1.1", "key-1", 3)
+	if decision, _ := rateLimiter.PeekN(ctx, "192.168.1.1", "key-1", 3); !decision.Limited || decision.RetryAfter != 6*3600 {
+		t.Errorf("Expected peek over the quota to be limited until midnight, got %+v", decision)
+	}
+
+	rateLimiter.RecordN(ctx, "192.168.1.1", "key-1", 4)
+	rateLimiter.RecordN(ctx, "192.168.1.1", "key-1", -1)
+	usage, _ := rateLimiter.Usage(ctx, config.tokenRule(), "key-1")
+	if usage.Used != 6 || usage.Remaining != 0 {
+		t.Errorf("Expected served responses to count past the quota, got %+v", usage)
+	}
+
+	if decision, _ := rateLimiter.Check(ctx, "192.168.1.1", "key-1"); !decision.Limited {
+		t.Errorf("Expected the token to be over its quota, got %+v", decision)
+	}
+}
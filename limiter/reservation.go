@@ -0,0 +1,132 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxReserveWindows is how many windows ahead Reserve looks for room.
+const maxReserveWindows = 64
+
+// Reservation holds n units of a rule's limit in a window that may not have
+// started yet. The caller should wait Delay before acting, or Cancel to give
+// the units back.
+type Reservation struct {
+	rateLimiter *RateLimiter
+	key         string
+	n           int64
+	start       time.Time
+	end         time.Time
+
+	mutex    sync.Mutex
+	canceled bool
+}
+
+// Reserve reserves n units for key under rule in the first window that has
+// room for them, like golang.org/x/time/rate's Reserve but shared through the
+// storage by every instance.
+//
+// Reservations count in windows of BlockDuration seconds aligned to the Unix
+// epoch, so every instance agrees on them as long as their clocks do. They
+// are counted in their own keys, apart from Allow's counter, so a rule used
+// by both admits its limit in each; and they neither set nor check blocks,
+// so a key blocked by Allow can still be reserved.
+func (rl *RateLimiter) Reserve(ctx context.Context, rule Rule, key string, n int) (*Reservation, error) {
+	if rule.BlockDuration <= 0 {
+		return nil, fmt.Errorf("rule %q has no window", rule.Name)
+	}
+	if n <= 0 || n > rule.Limit {
+		return nil, fmt.Errorf("invalid cost %d for limit %d", n, rule.Limit)
+	}
+
+	window := time.Duration(rule.BlockDuration) * time.Second
+	now := rl.now()
+	index := now.Unix() / int64(rule.BlockDuration)
+
+	for i := int64(0); i < maxReserveWindows; i++ {
+		start := time.Unix((index+i)*int64(rule.BlockDuration), 0)
+		end := start.Add(window)
+		windowKey := fmt.Sprintf("%s:w%d", rule.key(key), index+i)
+
+		count, err := rl.storage.IncrementBy(ctx, windowKey, int64(n))
+		if err != nil {
+			return nil, err
+		}
+		if count == int64(n) {
+			// Outlive the window so Cancel never recreates the key.
+			err = rl.storage.SetExpiration(ctx, windowKey, int(end.Sub(now)/time.Second)+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if count <= int64(rule.Limit) {
+			return &Reservation{rateLimiter: rl, key: windowKey, n: int64(n), start: start, end: end}, nil
+		}
+
+		if _, err := rl.storage.IncrementBy(ctx, windowKey, -int64(n)); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no room for %d within %d windows of rule %q", n, maxReserveWindows, rule.Name)
+}
+
+// Wait blocks until one unit is available for key under rule.
+func (rl *RateLimiter) Wait(ctx context.Context, rule Rule, key string) error {
+	return rl.WaitN(ctx, rule, key, 1)
+}
+
+// WaitN blocks until n units are available for key under rule. It fails
+// without waiting when ctx would end first, and gives the units back when ctx
+// ends while waiting.
+func (rl *RateLimiter) WaitN(ctx context.Context, rule Rule, key string, n int) error {
+	reservation, err := rl.Reserve(ctx, rule, key, n)
+	if err != nil {
+		return err
+	}
+
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && delay > time.Until(deadline) {
+		reservation.Cancel(context.WithoutCancel(ctx))
+		return fmt.Errorf("rate limit wait of %v would exceed context deadline", delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel(context.WithoutCancel(ctx))
+		return ctx.Err()
+	}
+}
+
+// Delay is how long to wait before the reserved window starts.
+func (r *Reservation) Delay() time.Duration {
+	if delay := r.start.Sub(r.rateLimiter.now()); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Cancel gives the reserved units back, unless the window is over or the
+// reservation was already canceled.
+func (r *Reservation) Cancel(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.canceled || !r.rateLimiter.now().Before(r.end) {
+		return nil
+	}
+	if _, err := r.rateLimiter.storage.IncrementBy(ctx, r.key, -r.n); err != nil {
+		return err
+	}
+	r.canceled = true
+	return nil
+}
@@ -0,0 +1,124 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"rate-limiter/storage"
+)
+
+func newTestReservationLimiter(now time.Time) (*RateLimiter, *storage.MockStorage) {
+	mockStorage := storage.NewMockStorage()
+	rateLimiter := NewRateLimiter(mockStorage, &Config{})
+	rateLimiter.now = func() time.Time { return now }
+	return rateLimiter, mockStorage
+}
+
+func TestReserve(t *testing.T) {
+	// 10 seconds into a 60 second window.
+	now := time.Unix(1700000050, 0)
+	rateLimiter, mockStorage := newTestReservationLimiter(now)
+	rule := Rule{Name: "jobs", Limit: 3, BlockDuration: 60}
+	ctx := context.Background()
+
+	first, err := rateLimiter.Reserve(ctx, rule, "worker", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first.Delay() != 0 {
+		t.Errorf("Expected no delay, got %v", first.Delay())
+	}
+
+	second, _ := rateLimiter.Reserve(ctx, rule, "worker", 2)
+	if second.Delay() != 50*time.Second {
+		t.Errorf("Expected to wait for the next window, got %v", second.Delay())
+	}
+
+	if count, _ := mockStorage.GetCounter(ctx, "jobs:worker:w28333334"); count != 2 {
+		t.Errorf("Failed reservation should be rolled back, got count %d", count)
+	}
+	if count, _ := mockStorage.GetCounter(ctx, "jobs:worker:w28333335"); count != 2 {
+		t.Errorf("Expected 2 reserved in the next window, got %d", count)
+	}
+
+	if _, err := rateLimiter.Reserve(ctx, rule, "worker", 4); err == nil {
+		t.Error("Expected error for cost over the limit")
+	}
+	if _, err := rateLimiter.Reserve(ctx, Rule{Name: "jobs", Limit: 3}, "worker", 1); err == nil {
+		t.Error("Expected error for rule without window")
+	}
+}
+
+func TestReservation_Cancel(t *testing.T) {
+	now := time.Unix(1700000050, 0)
+	rateLimiter, mockStorage := newTestReservationLimiter(now)
+	rule := Rule{Name: "jobs", Limit: 3, BlockDuration: 60}
+	ctx := context.Background()
+
+	reservation, _ := rateLimiter.Reserve(ctx, rule, "worker", 3)
+	if err := reservation.Cancel(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reservation.Cancel(ctx)
+
+	if count, _ := mockStorage.GetCounter(ctx, "jobs:worker:w28333334"); count != 0 {
+		t.Errorf("Units should be returned once, got count %d", count)
+	}
+
+	next, _ := rateLimiter.Reserve(ctx, rule, "worker", 3)
+	if next.Delay() != 0 {
+		t.Errorf("Returned units should be reusable, got delay %v", next.Delay())
+	}
+
+	// Once the window is over there is nothing to give back.
+	rateLimiter.now = func() time.Time { return now.Add(time.Minute) }
+	next.Cancel(ctx)
+	if count, _ := mockStorage.GetCounter(ctx, "jobs:worker:w28333334"); count != 3 {
+		t.Errorf("Expired reservation should not be returned, got count %d", count)
+	}
+}
+
+func TestWait(t *testing.T) {
+	// 1ms before the end of a 1 second window.
+	now := time.Unix(1700000000, int64(999*time.Millisecond))
+	rateLimiter, _ := newTestReservationLimiter(now)
+	rule := Rule{Name: "jobs", Limit: 1, BlockDuration: 1}
+	ctx := context.Background()
+
+	if err := rateLimiter.Wait(ctx, rule, "worker"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	if err := rateLimiter.Wait(ctx, rule, "worker"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond {
+		t.Errorf("Expected to wait for the next window, took %v", elapsed)
+	}
+}
+
+func TestWait_Context(t *testing.T) {
+	now := time.Unix(1700000050, 0)
+	rateLimiter, mockStorage := newTestReservationLimiter(now)
+	rule := Rule{Name: "jobs", Limit: 1, BlockDuration: 60}
+	rateLimiter.Wait(context.Background(), rule, "worker")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rateLimiter.Wait(ctx, rule, "worker"); err == nil {
+		t.Error("Expected error when the wait exceeds the deadline")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := rateLimiter.Wait(ctx, rule, "worker"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled, got %v", err)
+	}
+
+	if count, _ := mockStorage.GetCounter(context.Background(), "jobs:worker:w28333335"); count != 0 {
+		t.Errorf("Abandoned waits should return their units, got count %d", count)
+	}
+}
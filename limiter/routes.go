@@ -0,0 +1,198 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route matches requests to Path, or to any path starting with it when Path
+// ends with "*". An empty Method matches every method.
+type Route struct {
+	Method string
+	Path   string
+}
+
+// RouteCost charges Cost units for each request matching its Method and
+// Path, as a Route.
+type RouteCost struct {
+	Method string
+	Path   string
+	Cost   int
+}
+
+// ParseRouteCosts parses route costs in the RATE_LIMIT_ROUTE_COSTS format:
+//
+//	POST /export=10;/search*=5
+func ParseRouteCosts(value string) ([]RouteCost, error) {
+	var routes []RouteCost
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid route cost %q: expected [METHOD] <path>=<cost>", entry)
+		}
+		cost, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || cost <= 0 {
+			return nil, fmt.Errorf("invalid route cost %q: cost must be a positive integer", entry)
+		}
+
+		route, err := ParseRoute(entry[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid route cost %q: %v", entry, err)
+		}
+
+		routes = append(routes, RouteCost{Method: route.Method, Path: route.Path, Cost: cost})
+	}
+
+	return routes, nil
+}
+
+// ParseRoute parses "[METHOD] <path>", e.g. "POST /export" or "/search*".
+func ParseRoute(value string) (Route, error) {
+	var route Route
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 1:
+		route.Path = fields[0]
+	case 2:
+		route.Method = strings.ToUpper(fields[0])
+		route.Path = fields[1]
+	default:
+		return Route{}, fmt.Errorf("expected [METHOD] <path>")
+	}
+	if !strings.HasPrefix(route.Path, "/") {
+		return Route{}, fmt.Errorf("path must start with /")
+	}
+	return route, nil
+}
+
+// RouteCost returns the cost of the first route cost matching the request,
+// or 1.
+func (rl *RateLimiter) RouteCost(method, path string) int {
+	for _, route := range rl.config.RouteCosts {
+		if route.matches(method, path) {
+			return route.Cost
+		}
+	}
+	return 1
+}
+
+func (r RouteCost) matches(method, path string) bool {
+	return Route{Method: r.Method, Path: r.Path}.matches(method, path)
+}
+
+func (r Route) matches(method, path string) bool {
+	if r.Method != "" && r.Method != method {
+		return false
+	}
+	if prefix, wildcard := strings.CutSuffix(r.Path, "*"); wildcard {
+		return strings.HasPrefix(path, prefix)
+	}
+	return r.Path == path
+}
+
+// CheckRoutes counts a request to method and path that costs n units under
+// the rules whose Route matches it: per client (the token when one is given,
+// otherwise the IP) or, for Global rules, across all clients.
+//
+// Client rules are counted before global ones, so requests already over their
+// own limits do not use up a global limit. When a rule limits the request, the
+// rules counted before it are refunded. Requests on the access lists are not
+// counted.
+func (rl *RateLimiter) CheckRoutes(ctx context.Context, method, path, ip, token string, n int) (*Decision, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid cost %d", n)
+	}
+	if len(rl.routeRules) == 0 {
+		return &Decision{}, nil
+	}
+	if _, listed := rl.access.match(ip, token); listed {
+		return &Decision{}, nil
+	}
+	subject, id := rl.config.subject(rl.config.ipID(ip), token)
+
+	var counted []string
+	var wouldLimit string
+	for _, rule := range rl.routeRules {
+		if !rule.Route.matches(method, path) {
+			continue
+		}
+		key := routeKey(rule, subject, id)
+
+		decision, err := rl.allowN(ctx, rule, key, int64(n), true)
+		if err != nil {
+			return nil, err
+		}
+		if decision.Limited {
+			for _, counter := range counted {
+				// Best effort: a failed refund only overcounts.
+				rl.storage.IncrementBy(ctx, counter, -int64(n))
+			}
+			return decision, nil
+		}
+		if wouldLimit == "" {
+			wouldLimit = decision.WouldLimit
+		}
+		counter, _ := rl.counter(rule, key)
+		counted = append(counted, counter)
+	}
+	return &Decision{WouldLimit: wouldLimit}, nil
+}
+
+// RefundRoutes gives back the n units CheckRoutes counted for a request that
+// it admitted but that did not proceed, e.g. rejected by the concurrency limit
+// or shed, so that it does not use up the route rules, global ones included.
+func (rl *RateLimiter) RefundRoutes(ctx context.Context, method, path, ip, token string, n int) error {
+	if n <= 0 || len(rl.routeRules) == 0 {
+		return nil
+	}
+	if _, listed := rl.access.match(ip, token); listed {
+		return nil
+	}
+	subject, id := rl.config.subject(rl.config.ipID(ip), token)
+
+	for _, rule := range rl.routeRules {
+		if !rule.Route.matches(method, path) {
+			continue
+		}
+		counter, _ := rl.counter(rule, routeKey(rule, subject, id))
+		if err := rl.refund(ctx, counter, int64(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeKey returns the key a route rule counts a client's requests under.
+func routeKey(rule Rule, subject Rule, id string) string {
+	if rule.Global {
+		return "global"
+	}
+	return subject.Name + ":" + id
+}
+
+// routeRules returns the rules with a Route, client rules first, each sorted
+// by name.
+func (c *Config) routeRules() []Rule {
+	var rules []Rule
+	for _, rule := range c.Rules {
+		if rule.Route.Path != "" {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Global != rules[j].Global {
+			return !rules[i].Global
+		}
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
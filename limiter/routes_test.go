@@ -0,0 +1,187 @@
+package limiter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"rate-limiter/storage"
+)
+
+func TestParseRouteCosts(t *testing.T) {
+	routes, err := ParseRouteCosts(" post /export=10; /search*=5 ;")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []RouteCost{
+		{Method: "POST", Path: "/export", Cost: 10},
+		{Path: "/search*", Cost: 5},
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, routes)
+	}
+}
+
+func TestParseRouteCosts_Invalid(t *testing.T) {
+	tests := []string{
+		"/export",
+		"/export=0",
+		"/export=abc",
+		"export=1",
+		"POST /export extra=1",
+	}
+
+	for _, value := range tests {
+		if _, err := ParseRouteCosts(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestRateLimiter_RouteCost(t *testing.T) {
+	config := &Config{RouteCosts: []RouteCost{
+		{Method: "POST", Path: "/export", Cost: 10},
+		{Path: "/search*", Cost: 5},
+	}}
+	rateLimiter := NewRateLimiter(storage.NewMockStorage(), config)
+
+	tests := []struct {
+		method string
+		path   string
+		cost   int
+	}{
+		{"POST", "/export", 10},
+		{"GET", "/export", 1},
+		{"GET", "/search", 5},
+		{"GET", "/search/users", 5},
+		{"GET", "/test", 1},
+	}
+	for _, tt := range tests {
+		if cost := rateLimiter.RouteCost(tt.method, tt.path); cost != tt.cost {
+			t.Errorf("%s %s: expected cost %d, got %d", tt.method, tt.path, tt.cost, cost)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Route
+	}{
+		{"/search*", Route{Path: "/search*"}},
+		{" post /export ", Route{Method: "POST", Path: "/export"}},
+	}
+	for _, tt := range tests {
+		route, err := ParseRoute(tt.value)
+		if err != nil || route != tt.expected {
+			t.Errorf("ParseRoute(%q): expected %+v, got %+v, %v", tt.value, tt.expected, route, err)
+		}
+	}
+
+	for _, value := range []string{"", "export", "GET /export extra"} {
+		if _, err := ParseRoute(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{
+		IPLimit:            100,
+		IPBlockDuration:    300,
+		TokenLimit:         100,
+		TokenBlockDuration: 300,
+		Rules: map[string]Rule{
+			"search_global": {Name: "search_global", Limit: 3, BlockDuration: 1, Route: Route{Method: "GET", Path: "/search*"}, Global: true},
+			"search":        {Name: "search", Limit: 2, BlockDuration: 60, Route: Route{Path: "/search*"}},
+			"login":         {Name: "login", Limit: 5},
+		},
+		Allowlist: []string{"10.0.0.0/8"},
+	}
+	rl := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		decision, err := rl.CheckRoutes(ctx, "GET", "/search/users", "192.168.1.1", "", 1)
+		if err != nil || decision.Limited {
+			t.Fatalf("Request %d: expected allowed, got %+v, %v", i+1, decision, err)
+		}
+	}
+
+	decision, _ := rl.CheckRoutes(ctx, "GET", "/search", "192.168.1.1", "", 1)
+	if !decision.Limited || decision.Global || decision.RetryAfter != 60 {
+		t.Errorf("Expected the client rule to limit, got %+v", decision)
+	}
+	if count, _ := mockStorage.GetCounter(ctx, "search_global:global"); count != 2 {
+		t.Errorf("Expected requests over the client rule not to count globally, got %d", count)
+	}
+
+	decision, _ = rl.CheckRoutes(ctx, "GET", "/search", "192.168.1.2", "", 1)
+	if decision.Limited {
+		t.Errorf("Expected another client to be allowed, got %+v", decision)
+	}
+
+	decision, _ = rl.CheckRoutes(ctx, "GET", "/search", "192.168.1.3", "", 1)
+	if !decision.Limited || !decision.Global || decision.RetryAfter != 1 {
+		t.Errorf("Expected the global rule to limit, got %+v", decision)
+	}
+	if count, _ := mockStorage.GetCounter(ctx, "search:ip:192.168.1.3"); count != 0 {
+		t.Errorf("Expected the client rule to be refunded, got %d", count)
+	}
+
+	tests := []struct {
+		method  string
+		path    string
+		ip      string
+		limited bool
+	}{
+		{"POST", "/search", "192.168.1.1", true},
+		{"POST", "/search", "192.168.1.4", false},
+		{"GET", "/search", "10.0.0.1", false},
+		{"GET", "/login", "192.168.1.4", false},
+	}
+	for _, tt := range tests {
+		decision, err := rl.CheckRoutes(ctx, tt.method, tt.path, tt.ip, "", 1)
+		if err != nil || decision.Limited != tt.limited || decision.Global {
+			t.Errorf("%s %s from %s: expected limited %v, got %+v, %v", tt.method, tt.path, tt.ip, tt.limited, decision, err)
+		}
+	}
+
+	if _, err := rl.CheckRoutes(ctx, "GET", "/search", "192.168.1.1", "", 0); err == nil {
+		t.Error("Expected error for a zero cost")
+	}
+}
+
+func TestRefundRoutes(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &Config{
+		IPLimit:            100,
+		IPBlockDuration:    300,
+		TokenLimit:         100,
+		TokenBlockDuration: 300,
+		Rules: map[string]Rule{
+			"search_global": {Name: "search_global", Limit: 3, BlockDuration: 1, Route: Route{Path: "/search*"}, Global: true},
+			"search":        {Name: "search", Limit: 2, BlockDuration: 60, Route: Route{Path: "/search*"}},
+		},
+	}
+	rl := NewRateLimiter(mockStorage, config)
+	ctx := context.Background()
+
+	rl.CheckRoutes(ctx, "GET", "/search", "192.168.1.1", "", 2)
+	if err := rl.RefundRoutes(ctx, "GET", "/search", "192.168.1.1", "", 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, key := range []string{"search_global:global", "search:ip:192.168.1.1"} {
+		if count, _ := mockStorage.GetCounter(ctx, key); count != 0 {
+			t.Errorf("Expected %s to be refunded, got %d", key, count)
+		}
+	}
+
+	// A refund never leaves a counter below zero.
+	rl.RefundRoutes(ctx, "GET", "/search", "192.168.1.1", "", 1)
+	if count, _ := mockStorage.GetCounter(ctx, "search_global:global"); count != 0 {
+		t.Errorf("Expected the counter to stay at zero, got %d", count)
+	}
+}
@@ -0,0 +1,179 @@
+package limiter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverrideRulePrefix starts the names of the rules synthesized for limit
+// overrides, such as Envoy's, so that they never share counters with
+// configured rules, which cannot use it.
+const OverrideRulePrefix = "rls:"
+
+// ParseRules parses named rules in the RATE_LIMIT_RULES format:
+//
+//	search:limit=100,block_duration=60;export:limit=5,block_duration=3600
+//
+// max_block_duration and penalty_window escalate the blocks of repeat
+// offenders, and period (day or month) with an optional timezone makes the
+// rule a calendar quota, see Rule:
+//
+//	api:limit=10000,period=month,timezone=America/Sao_Paulo
+//
+// route applies the rule to the matching requests, and scope=global counts
+// them across all clients instead of per client:
+//
+//	search_global:limit=5000,block_duration=1,route=GET /search*,scope=global
+//
+// dry_run=true only reports the requests the rule would limit:
+//
+//	export_new:limit=2,block_duration=60,route=POST /export,dry_run=true
+//
+// block_duration is required and positive unless the rule has a period, as
+// it is also the length of the rule's window.
+//
+// Names may contain ":", e.g. "api:v2:limit=100,block_duration=60": the
+// attributes start after the first ":" followed by a known attribute, such as
+// "limit=". The names "ip" and "token" are reserved for the default rules,
+// and names starting with OverrideRulePrefix for limit overrides.
+func ParseRules(value string) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, attrs, found := cutRule(entry)
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid rule %q: expected <name>:<attributes>", entry)
+		}
+		if name == "ip" || name == "token" {
+			return nil, fmt.Errorf("invalid rule %q: name %q is reserved", entry, name)
+		}
+		if strings.HasPrefix(name, OverrideRulePrefix) {
+			return nil, fmt.Errorf("invalid rule %q: prefix %q is reserved", entry, OverrideRulePrefix)
+		}
+		if _, exists := rules[name]; exists {
+			return nil, fmt.Errorf("duplicate rule %q", name)
+		}
+
+		rule := Rule{Name: name}
+		for _, attr := range strings.Split(attrs, ",") {
+			key, val, found := strings.Cut(strings.TrimSpace(attr), "=")
+			if !found {
+				return nil, fmt.Errorf("invalid rule %q: expected <attribute>=<value>, got %q", name, attr)
+			}
+			if err := rule.set(strings.TrimSpace(key), strings.TrimSpace(val)); err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %v", name, err)
+			}
+		}
+		if rule.Limit <= 0 {
+			return nil, fmt.Errorf("invalid rule %q: limit must be positive", name)
+		}
+		// The window of a rule lasts BlockDuration: without one its counter
+		// would expire as soon as it is created.
+		if rule.Period == "" && rule.BlockDuration <= 0 {
+			return nil, fmt.Errorf("invalid rule %q: block_duration must be positive", name)
+		}
+
+		rules[name] = rule
+	}
+
+	return rules, nil
+}
+
+// ruleAttributes are the attributes Rule.set accepts.
+var ruleAttributes = map[string]bool{
+	"limit": true, "block_duration": true, "max_block_duration": true, "penalty_window": true,
+	"period": true, "timezone": true, "route": true, "dry_run": true, "scope": true,
+}
+
+// cutRule splits a rule entry into its name and attributes at the first ":"
+// followed by an attribute, so that names may contain ":" themselves. Without
+// one it splits at the last ":", leaving the unknown attribute to be reported.
+func cutRule(entry string) (string, string, bool) {
+	for i := 0; i < len(entry); i++ {
+		if entry[i] != ':' {
+			continue
+		}
+		key, _, found := strings.Cut(entry[i+1:], "=")
+		if found && ruleAttributes[strings.TrimSpace(key)] {
+			return entry[:i], entry[i+1:], true
+		}
+	}
+	i := strings.LastIndex(entry, ":")
+	if i < 0 {
+		return entry, "", false
+	}
+	return entry[:i], entry[i+1:], true
+}
+
+func (r *Rule) set(key, value string) error {
+	switch key {
+	case "limit":
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q", value)
+		}
+		r.Limit = limit
+	case "block_duration":
+		duration, err := strconv.Atoi(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid block_duration %q", value)
+		}
+		r.BlockDuration = duration
+	case "max_block_duration":
+		duration, err := strconv.Atoi(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid max_block_duration %q", value)
+		}
+		r.MaxBlockDuration = duration
+	case "penalty_window":
+		window, err := strconv.Atoi(value)
+		if err != nil || window < 0 {
+			return fmt.Errorf("invalid penalty_window %q", value)
+		}
+		r.PenaltyWindow = window
+	case "period":
+		period, err := ParsePeriod(value)
+		if err != nil || period == "" {
+			return fmt.Errorf("invalid period %q: expected day or month", value)
+		}
+		r.Period = period
+	case "timezone":
+		location, err := time.LoadLocation(value)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q", value)
+		}
+		r.Location = location
+	case "route":
+		route, err := ParseRoute(value)
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %v", value, err)
+		}
+		r.Route = route
+	case "dry_run":
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid dry_run %q", value)
+		}
+		r.DryRun = dryRun
+	case "scope":
+		switch value {
+		case "client":
+			r.Global = false
+		case "global":
+			r.Global = true
+		default:
+			return fmt.Errorf("invalid scope %q: expected client or global", value)
+		}
+	default:
+		return fmt.Errorf("unknown attribute %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package limiter
+
+import "testing"
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(" search:limit=100,block_duration=60 ; export:limit=5,block_duration=1; login:limit=5,block_duration=60,max_block_duration=3600,penalty_window=86400")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(rules))
+	}
+	if rule := rules["search"]; rule != (Rule{Name: "search", Limit: 100, BlockDuration: 60}) {
+		t.Errorf("Unexpected search rule: %+v", rule)
+	}
+	if rule := rules["export"]; rule != (Rule{Name: "export", Limit: 5, BlockDuration: 1}) {
+		t.Errorf("Unexpected export rule: %+v", rule)
+	}
+	if rule := rules["login"]; rule != (Rule{Name: "login", Limit: 5, BlockDuration: 60, MaxBlockDuration: 3600, PenaltyWindow: 86400}) {
+		t.Errorf("Unexpected login rule: %+v", rule)
+	}
+
+	if rules, err := ParseRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("Expected no rules, got %v, %v", rules, err)
+	}
+}
+
+func TestParseRules_ColonNames(t *testing.T) {
+	rules, err := ParseRules("api:v2:limit=100,block_duration=60;generic_key=export.user:limit=5,block_duration=60;items:route=GET /items/:id,limit=3,block_duration=1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if rule := rules["api:v2"]; rule != (Rule{Name: "api:v2", Limit: 100, BlockDuration: 60}) {
+		t.Errorf("Unexpected api:v2 rule: %+v", rule)
+	}
+	if rule := rules["generic_key=export.user"]; rule != (Rule{Name: "generic_key=export.user", Limit: 5, BlockDuration: 60}) {
+		t.Errorf("Unexpected generic_key=export.user rule: %+v", rule)
+	}
+	if rule := rules["items"]; rule.Limit != 3 || rule.Route.Path != "/items/:id" {
+		t.Errorf("Unexpected items rule: %+v", rule)
+	}
+}
+
+func TestParseRules_Quota(t *testing.T) {
+	rules, err := ParseRules("api:limit=10000,period=month,timezone=America/Sao_Paulo;daily:limit=100,period=day")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if rule := rules["api"]; rule.Period != PeriodMonth || rule.Location == nil || rule.Location.String() != "America/Sao_Paulo" {
+		t.Errorf("Unexpected api rule: %+v", rule)
+	}
+	if rule := rules["daily"]; rule.Period != PeriodDay || rule.Location != nil {
+		t.Errorf("Unexpected daily rule: %+v", rule)
+	}
+}
+
+func TestParseRules_Route(t *testing.T) {
+	rules, err := ParseRules("search_global:limit=5000,block_duration=1,route=GET /search*,scope=global;export:limit=5,block_duration=60,route=/export,scope=client")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := Rule{Name: "search_global", Limit: 5000, BlockDuration: 1, Route: Route{Method: "GET", Path: "/search*"}, Global: true}
+	if rule := rules["search_global"]; rule != expected {
+		t.Errorf("Unexpected search_global rule: %+v", rule)
+	}
+	if rule := rules["export"]; rule != (Rule{Name: "export", Limit: 5, BlockDuration: 60, Route: Route{Path: "/export"}}) {
+		t.Errorf("Unexpected export rule: %+v", rule)
+	}
+}
+
+func TestParseRules_DryRun(t *testing.T) {
+	rules, err := ParseRules("export_new:limit=2,block_duration=60,route=POST /export,dry_run=true;search:limit=5,block_duration=60,dry_run=false")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if rule := rules["export_new"]; !rule.DryRun {
+		t.Errorf("Expected export_new to be a dry-run rule, got %+v", rule)
+	}
+	if rule := rules["search"]; rule.DryRun {
+		t.Errorf("Expected search to be enforced, got %+v", rule)
+	}
+	if _, err := ParseRules("search:limit=5,block_duration=60,dry_run=maybe"); err == nil {
+		t.Error("Expected error for an invalid dry_run")
+	}
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	tests := []string{
+		"search",
+		":limit=1",
+		"search:limit",
+		"search:limit=abc",
+		"search:limit=0",
+		"search:limit=1",
+		"search:limit=1,block_duration=0",
+		"search:limit=1,block_duration=-1",
+		"search:limit=1,block_duration=1,unknown=1",
+		"search:limit=1,block_duration=1,max_block_duration=-1",
+		"search:limit=1,block_duration=1,penalty_window=abc",
+		"search:limit=1,period=week",
+		"search:limit=1,period=month,timezone=Mars/Olympus",
+		"search:limit=1,block_duration=1,route=search",
+		"search:limit=1,block_duration=1,route=GET /search extra",
+		"search:limit=1,block_duration=1,route=/search,scope=world",
+		"search:limit=1,block_duration=1;search:limit=2,block_duration=1",
+		"ip:limit=1,block_duration=1",
+		"token:limit=1,block_duration=1",
+		"rls:edge:tenant:limit=1,block_duration=1",
+	}
+
+	for _, value := range tests {
+		if _, err := ParseRules(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"rate-limiter/limiter"
 	"rate-limiter/middleware"
+	"rate-limiter/rls"
+	"rate-limiter/server"
 	"rate-limiter/storage"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -18,37 +31,156 @@ func main() {
 		log.Fatal("Error loading config.env file")
 	}
 
-	// Initialize Redis storage
-	redisStorage, err := storage.NewRedisStorage()
-	if err != nil {
-		log.Fatalf("Failed to initialize Redis storage: %v", err)
+	// Initialize storage, with what to close on shutdown in order
+	var store storage.Storage
+	var closers []io.Closer
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "memory":
+		memoryOptions, err := storage.MemoryOptionsFromEnv()
+		if err != nil {
+			log.Fatalf("Invalid memory storage configuration: %v", err)
+		}
+		memoryStorage := storage.NewMemoryStorage(memoryOptions)
+		store = memoryStorage
+		closers = []io.Closer{memoryStorage}
+	case "", "redis":
+		redisStorage, err := storage.NewRedisStorage()
+		if err != nil {
+			log.Fatalf("Failed to initialize Redis storage: %v", err)
+		}
+		store = redisStorage
+		closers = []io.Closer{redisStorage}
+	case "hybrid":
+		hybridOptions, err := storage.HybridOptionsFromEnv()
+		if err != nil {
+			log.Fatalf("Invalid hybrid storage configuration: %v", err)
+		}
+		redisStorage, err := storage.NewRedisStorage()
+		if err != nil {
+			log.Fatalf("Failed to initialize Redis storage: %v", err)
+		}
+		hybridStorage := storage.NewHybridStorage(redisStorage, hybridOptions)
+		store = hybridStorage
+		// The hybrid storage flushes its pending counts to Redis on Close
+		closers = []io.Closer{hybridStorage, redisStorage}
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q", backend)
 	}
 
 	// Initialize rate limiter
-	config := limiter.NewConfig()
-	rateLimiter := limiter.NewRateLimiter(redisStorage, config)
+	config, err := limiter.NewConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	rateLimiter := limiter.NewRateLimiter(store, config)
 
 	// Initialize Gin router
 	router := gin.Default()
 
-	// Apply rate limiter middleware
-	router.Use(middleware.RateLimitMiddleware(rateLimiter))
+	// Expose metrics, before the rate limiter so they are never limited
+	if rateLimiter.Adaptive() {
+		expvar.Publish("adaptive_limits", expvar.Func(func() any {
+			return rateLimiter.AdaptiveStats()
+		}))
+	}
+	expvar.Publish("dry_run_limits", expvar.Func(func() any {
+		return rateLimiter.DryRunStats()
+	}))
+	if metricsPath := os.Getenv("METRICS_PATH"); metricsPath != "" {
+		router.GET(metricsPath, gin.WrapH(expvar.Handler()))
+	}
+
+	switch mode := os.Getenv("SERVER_MODE"); mode {
+	case "", "middleware":
+		ipResolver, err := middleware.NewIPResolver(middleware.ProxyOptionsFromEnv())
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+
+		// Apply rate limiter middleware
+		router.Use(middleware.RateLimitMiddleware(rateLimiter,
+			middleware.WithIPResolver(ipResolver),
+			middleware.WithPriorityHeader(os.Getenv("PRIORITY_HEADER")),
+		))
+
+		// Let API keys read their own quota usage
+		server.RegisterUsageRoutes(router, rateLimiter)
 
-	// Add a test endpoint
-	router.GET("/test", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"message": "Rate limit test successful",
+		// Add a test endpoint
+		router.GET("/test", func(c *gin.Context) {
+			c.JSON(200, gin.H{
+				"message": "Rate limit test successful",
+			})
 		})
-	})
+	case "decision":
+		// Expose the limiter to other services
+		server.RegisterRoutes(router, rateLimiter)
+	default:
+		log.Fatalf("Unknown SERVER_MODE %q", mode)
+	}
+
+	// Stop on SIGINT or SIGTERM, or when a server fails
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 2)
+
+	// Serve Envoy's rate limit service
+	var grpcServer *grpc.Server
+	if rlsPort := os.Getenv("RLS_PORT"); rlsPort != "" {
+		listener, err := net.Listen("tcp", ":"+rlsPort)
+		if err != nil {
+			log.Fatalf("Failed to listen on RLS port: %v", err)
+		}
+		grpcServer = grpc.NewServer()
+		rls.Register(grpcServer, rateLimiter)
+
+		log.Printf("Envoy rate limit service starting on port %s", rlsPort)
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				serveErr <- fmt.Errorf("failed to start rate limit service: %w", err)
+			}
+		}()
+	}
 
 	// Start the server
 	port := os.Getenv("SERVER_PORT")
 	if port == "" {
 		port = "8080"
 	}
+	httpServer := &http.Server{Addr: ":" + port, Handler: router}
 
 	log.Printf("Server starting on port %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	go func() {
+		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- fmt.Errorf("failed to start server: %w", err)
+		}
+	}()
+
+	var failed error
+	select {
+	case <-ctx.Done():
+		log.Print("Shutting down")
+	case failed = <-serveErr:
+		log.Printf("Shutting down: %v", failed)
+	}
+
+	// Let in-flight requests finish, then close the storage so pending
+	// counts are not lost
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down server: %v", err)
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close storage: %v", err)
+		}
+	}
+
+	if failed != nil {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// DefaultClientIPHeaders are read, in order, when ProxyOptions.Headers is
+// empty.
+var DefaultClientIPHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"}
+
+type ProxyOptions struct {
+	// TrustedProxies are the CIDRs or IPs of the proxies whose client IP
+	// headers are believed. Without them the peer address is always used.
+	TrustedProxies []string
+	// Headers are the client IP headers to read, in order, e.g.
+	// CF-Connecting-IP behind Cloudflare. Defaults to DefaultClientIPHeaders.
+	Headers []string
+}
+
+func ProxyOptionsFromEnv() ProxyOptions {
+	return ProxyOptions{
+		TrustedProxies: splitList(os.Getenv("TRUSTED_PROXIES")),
+		Headers:        splitList(os.Getenv("CLIENT_IP_HEADERS")),
+	}
+}
+
+// IPResolver finds the client IP of a request, believing client IP headers
+// only when they were set by a trusted proxy.
+type IPResolver struct {
+	trusted []netip.Prefix
+	headers []string
+}
+
+func NewIPResolver(opts ProxyOptions) (*IPResolver, error) {
+	resolver := &IPResolver{headers: opts.Headers}
+	if len(resolver.headers) == 0 {
+		resolver.headers = DefaultClientIPHeaders
+	}
+
+	for _, proxy := range opts.TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		resolver.trusted = append(resolver.trusted, prefix.Masked())
+	}
+
+	return resolver, nil
+}
+
+// ClientIP returns the client IP of r, or "" when its peer address is
+// invalid.
+//
+// Headers are only read when the peer is a trusted proxy. In the Forwarded
+// and X-Forwarded-For chains every proxy appends the address it received the
+// request from, so the chain is walked from the right and the first address
+// that is not a trusted proxy is the client; addresses further left could
+// have been made up by the client. Other headers hold a single address.
+func (r *IPResolver) ClientIP(req *http.Request) string {
+	peer, ok := peerAddr(req)
+	if !ok {
+		return ""
+	}
+	if !r.isTrusted(peer) {
+		return peer.String()
+	}
+
+	for _, header := range r.headers {
+		values := req.Header.Values(header)
+		if len(values) == 0 {
+			continue
+		}
+
+		var chain []string
+		switch http.CanonicalHeaderKey(header) {
+		case "Forwarded":
+			chain = forwardedFor(values)
+		case "X-Forwarded-For":
+			chain = splitList(strings.Join(values, ","))
+		default:
+			if addr, ok := parseIP(values[0]); ok {
+				return addr.String()
+			}
+			continue
+		}
+
+		if addr, ok := r.clientFromChain(chain); ok {
+			return addr.String()
+		}
+	}
+
+	return peer.String()
+}
+
+// fromTrustedProxy reports whether req came through a trusted proxy, whose
+// headers can be believed.
+func (r *IPResolver) fromTrustedProxy(req *http.Request) bool {
+	peer, ok := peerAddr(req)
+	return ok && r.isTrusted(peer)
+}
+
+func peerAddr(req *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(req.RemoteAddr))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return peer.Unmap(), true
+}
+
+func (r *IPResolver) clientFromChain(chain []string) (netip.Addr, bool) {
+	var client netip.Addr
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseIP(chain[i])
+		if !ok {
+			// Nothing left of an unreadable hop can be trusted.
+			return netip.Addr{}, false
+		}
+		client = addr
+		if !r.isTrusted(addr) {
+			return addr, true
+		}
+	}
+	// Every hop is a trusted proxy: the leftmost one is the client.
+	return client, client.IsValid()
+}
+
+func (r *IPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the "for" addresses of RFC 7239 Forwarded headers,
+// e.g. `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`.
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseIP reads an address that may carry a port or IPv6 brackets.
+func parseIP(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func resolveClientIP(t *testing.T, opts ProxyOptions, remoteAddr string, headers http.Header) string {
+	resolver, err := NewIPResolver(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = remoteAddr
+	for name, values := range headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	return resolver.ClientIP(req)
+}
+
+func TestIPResolver_UntrustedPeer(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For":  {"10.0.0.1"},
+		"X-Real-Ip":        {"10.0.0.2"},
+		"Forwarded":        {"for=10.0.0.3"},
+		"Cf-Connecting-Ip": {"10.0.0.4"},
+	}
+	opts := ProxyOptions{Headers: []string{"CF-Connecting-IP", "Forwarded", "X-Forwarded-For", "X-Real-IP"}}
+
+	if ip := resolveClientIP(t, opts, "192.168.1.1:12345", headers); ip != "192.168.1.1" {
+		t.Errorf("Headers from untrusted peers should be ignored, got %q", ip)
+	}
+
+	opts.TrustedProxies = []string{"172.16.0.0/12"}
+	if ip := resolveClientIP(t, opts, "192.168.1.1:12345", headers); ip != "192.168.1.1" {
+		t.Errorf("Headers from peers outside the trusted CIDRs should be ignored, got %q", ip)
+	}
+}
+
+func TestIPResolver_XForwardedFor(t *testing.T) {
+	opts := ProxyOptions{TrustedProxies: []string{"172.16.0.0/12", "192.168.1.1"}}
+
+	tests := []struct {
+		name     string
+		values   []string
+		expected string
+	}{
+		{"single hop", []string{"10.0.0.1"}, "10.0.0.1"},
+		{"spoofed entry", []string{"1.2.3.4, 10.0.0.1"}, "10.0.0.1"},
+		{"trusted hops", []string{"1.2.3.4, 10.0.0.1, 172.16.0.5"}, "10.0.0.1"},
+		{"multiple headers", []string{"1.2.3.4", "10.0.0.1, 172.16.0.5"}, "10.0.0.1"},
+		{"only proxies", []string{"172.16.0.6, 172.16.0.5"}, "172.16.0.6"},
+		{"invalid hop", []string{"10.0.0.1, garbage"}, "192.168.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": tt.values}
+			if ip := resolveClientIP(t, opts, "192.168.1.1:12345", headers); ip != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, ip)
+			}
+		})
+	}
+}
+
+func TestIPResolver_Forwarded(t *testing.T) {
+	opts := ProxyOptions{TrustedProxies: []string{"192.168.1.0/24"}}
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"ipv4", "for=192.0.2.60;proto=http;by=203.0.113.43", "192.0.2.60"},
+		{"ipv6 with port", `For="[2001:db8:cafe::17]:4711"`, "2001:db8:cafe::17"},
+		{"chain", "for=1.2.3.4, for=192.0.2.60;proto=https", "192.0.2.60"},
+		{"obfuscated", "for=_hidden", "192.168.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"Forwarded": {tt.value}}
+			if ip := resolveClientIP(t, opts, "192.168.1.1:12345", headers); ip != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, ip)
+			}
+		})
+	}
+}
+
+func TestIPResolver_RealIP(t *testing.T) {
+	opts := ProxyOptions{TrustedProxies: []string{"192.168.1.1"}}
+
+	if ip := resolveClientIP(t, opts, "192.168.1.1:12345", http.Header{"X-Real-Ip": {"10.0.0.3"}}); ip != "10.0.0.3" {
+		t.Errorf("Expected X-Real-IP, got %q", ip)
+	}
+	if ip := resolveClientIP(t, opts, "192.168.1.1:12345", http.Header{"X-Real-Ip": {"garbage"}}); ip != "192.168.1.1" {
+		t.Errorf("Invalid X-Real-IP should be ignored, got %q", ip)
+	}
+}
+
+func TestIPResolver_CDNHeader(t *testing.T) {
+	opts := ProxyOptions{
+		TrustedProxies: []string{"173.245.48.0/20"},
+		Headers:        []string{"CF-Connecting-IP"},
+	}
+	headers := http.Header{
+		"Cf-Connecting-Ip": {"203.0.113.9"},
+		"X-Forwarded-For":  {"10.0.0.1"},
+	}
+
+	if ip := resolveClientIP(t, opts, "173.245.48.10:443", headers); ip != "203.0.113.9" {
+		t.Errorf("Expected CF-Connecting-IP, got %q", ip)
+	}
+	if ip := resolveClientIP(t, opts, "198.51.100.7:443", headers); ip != "198.51.100.7" {
+		t.Errorf("CF-Connecting-IP from outside the CDN should be ignored, got %q", ip)
+	}
+}
+
+func TestIPResolver_PeerAddress(t *testing.T) {
+	opts := ProxyOptions{}
+
+	if ip := resolveClientIP(t, opts, "[::ffff:192.168.1.1]:12345", nil); ip != "192.168.1.1" {
+		t.Errorf("IPv4-mapped peers should be unmapped, got %q", ip)
+	}
+	if ip := resolveClientIP(t, opts, "[2001:db8::1]:12345", nil); ip != "2001:db8::1" {
+		t.Errorf("Expected IPv6 peer, got %q", ip)
+	}
+	if ip := resolveClientIP(t, opts, "", http.Header{"X-Forwarded-For": {"10.0.0.1"}}); ip != "" {
+		t.Errorf("Expected no IP without a peer address, got %q", ip)
+	}
+}
+
+func TestNewIPResolver_Invalid(t *testing.T) {
+	if _, err := NewIPResolver(ProxyOptions{TrustedProxies: []string{"not-a-cidr"}}); err == nil {
+		t.Error("Expected error for invalid trusted proxy")
+	}
+}
+
+func TestProxyOptionsFromEnv(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	t.Setenv("CLIENT_IP_HEADERS", "CF-Connecting-IP")
+
+	opts := ProxyOptionsFromEnv()
+	if len(opts.TrustedProxies) != 2 || opts.TrustedProxies[1] != "192.168.1.1" {
+		t.Errorf("Unexpected trusted proxies: %v", opts.TrustedProxies)
+	}
+	if len(opts.Headers) != 1 || opts.Headers[0] != "CF-Connecting-IP" {
+		t.Errorf("Unexpected headers: %v", opts.Headers)
+	}
+}
+
+func TestRateLimitHandler_SpoofedHeaders(t *testing.T) {
+	rateLimiter, _ := newTestRateLimiter(1, 10)
+	handler := setupTestHandler(rateLimiter)
+
+	for i, spoofed := range []string{"10.0.0.1", "10.0.0.2"} {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("X-Forwarded-For", spoofed)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if i == 1 && w.Code != http.StatusTooManyRequests {
+			t.Errorf("Rotating X-Forwarded-For should not escape the limit, got status %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rate-limiter/limiter"
+)
+
+const tokenHeader = "API_KEY"
+
+// Option configures RateLimitMiddleware and RateLimitHandler.
+type Option func(*options)
+
+type options struct {
+	cost           func(r *http.Request) int
+	responseCost   func(info ResponseInfo) int
+	precharge      bool
+	ipResolver     *IPResolver
+	priority       func(r *http.Request) string
+	priorityHeader string
+}
+
+// WithCost computes the cost of each request, e.g. from its page size. A
+// result of 0 or less falls back to the configured route costs.
+func WithCost(cost func(r *http.Request) int) Option {
+	return func(o *options) {
+		o.cost = cost
+	}
+}
+
+// WithIPResolver sets how client IPs are found. By default client IP headers
+// are ignored and the peer address is used.
+func WithIPResolver(resolver *IPResolver) Option {
+	return func(o *options) {
+		o.ipResolver = resolver
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.ipResolver == nil {
+		o.ipResolver, _ = NewIPResolver(ProxyOptions{})
+	}
+	return o
+}
+
+// RateLimitHandler returns a net/http middleware, usable with chi, echo or a
+// plain http.ServeMux, that applies the same checks as RateLimitMiddleware.
+//
+// With a concurrency limit configured, requests also hold an in-flight slot
+// while the next handler runs. With adaptive limits, the latency and status of
+// every handled request are observed.
+func RateLimitHandler(limiter *limiter.RateLimiter, opts ...Option) func(http.Handler) http.Handler {
+	o := newOptions(opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			charged, ok := checkRequest(limiter, o, w, r)
+			if !ok {
+				return
+			}
+			lease, ok := acquireSlot(limiter, o, w, r, charged)
+			if !ok {
+				return
+			}
+			defer lease.Release(context.WithoutCancel(r.Context()))
+			if !shedRequest(limiter, o, w, r, charged) {
+				return
+			}
+
+			if o.responseCost == nil && !limiter.Adaptive() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			recorder := &responseRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			recordResponse(limiter, o, ResponseInfo{
+				Request: r,
+				Status:  recorder.status,
+				Bytes:   recorder.bytes,
+				Latency: time.Since(start),
+			}, charged.client)
+		})
+	}
+}
+
+// charge is what checkRequest counted for a request: client units under
+// CheckN and route units under CheckRoutes.
+type charge struct {
+	client int
+	routes int
+}
+
+// checkRequest runs the limiter for r and sets the rate limit headers,
+// returning what it charged. When the request must not proceed it writes the
+// error response and returns false.
+func checkRequest(rateLimiter *limiter.RateLimiter, o *options, w http.ResponseWriter, r *http.Request) (charge, bool) {
+	ip, token := o.ipResolver.ClientIP(r), r.Header.Get(tokenHeader)
+	cost := o.requestCost(rateLimiter, r)
+
+	var decision *limiter.Decision
+	var err error
+	charged := 0
+	if o.responseCost != nil && !o.precharge {
+		decision, err = rateLimiter.PeekN(r.Context(), ip, token, cost)
+	} else {
+		decision, err = rateLimiter.CheckN(r.Context(), ip, token, cost)
+		charged = cost
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return charge{}, false
+	}
+
+	if decision.Denied {
+		writeError(w, http.StatusForbidden, limiter.AccessDeniedMessage)
+		return charge{}, false
+	}
+	if decision.Allowlisted {
+		return charge{}, true
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+
+	if decision.Limited {
+		writeLimited(w, decision)
+		return charge{}, false
+	}
+
+	// CheckRoutes refunds its own rules when one of them limits the request.
+	routeDecision, err := rateLimiter.CheckRoutes(r.Context(), r.Method, r.URL.Path, ip, token, cost)
+	if err != nil || routeDecision.Limited {
+		refund(rateLimiter, r, ip, token, charge{client: charged})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Internal server error")
+		} else {
+			writeLimited(w, routeDecision)
+		}
+		return charge{}, false
+	}
+	if routeDecision.WouldLimit != "" {
+		w.Header().Set("X-RateLimit-Dry-Run", routeDecision.WouldLimit)
+	}
+
+	return charge{client: charged, routes: cost}, true
+}
+
+// acquireSlot takes an in-flight slot for r. When the request must not
+// proceed it writes the error response, refunds what checkRequest charged and
+// returns false.
+func acquireSlot(rateLimiter *limiter.RateLimiter, o *options, w http.ResponseWriter, r *http.Request, charged charge) (*limiter.Lease, bool) {
+	ip, token := o.ipResolver.ClientIP(r), r.Header.Get(tokenHeader)
+
+	lease, decision, err := rateLimiter.Acquire(r.Context(), ip, token)
+	if err == nil && !decision.Limited {
+		return lease, true
+	}
+
+	refund(rateLimiter, r, ip, token, charged)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return nil, false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(decision.RetryAfter))
+	writeError(w, http.StatusTooManyRequests, limiter.ConcurrencyExceededMessage)
+	return nil, false
+}
+
+// refund gives back what checkRequest charged for a request that did not
+// proceed, to the client's limit and to the route rules.
+func refund(rateLimiter *limiter.RateLimiter, r *http.Request, ip, token string, charged charge) {
+	ctx := context.WithoutCancel(r.Context())
+	if charged.client > 0 {
+		rateLimiter.RecordN(ctx, ip, token, -charged.client)
+	}
+	if charged.routes > 0 {
+		rateLimiter.RefundRoutes(ctx, r.Method, r.URL.Path, ip, token, charged.routes)
+	}
+}
+
+// writeLimited answers 429, telling global limits, which no client can avoid
+// by slowing down alone, apart from the client's own with X-RateLimit-Scope.
+func writeLimited(w http.ResponseWriter, decision *limiter.Decision) {
+	w.Header().Set("Retry-After", strconv.Itoa(decision.RetryAfter))
+	if decision.Global {
+		w.Header().Set("X-RateLimit-Scope", "global")
+		writeError(w, http.StatusTooManyRequests, limiter.GlobalLimitExceededMessage)
+		return
+	}
+	w.Header().Set("X-RateLimit-Scope", "client")
+	writeError(w, http.StatusTooManyRequests, limiter.LimitExceededMessage)
+}
+
+func (o *options) requestCost(rateLimiter *limiter.RateLimiter, r *http.Request) int {
+	if o.cost != nil {
+		if cost := o.cost(r); cost > 0 {
+			return cost
+		}
+	}
+	return rateLimiter.RouteCost(r.Method, r.URL.Path)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,428 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"rate-limiter/limiter"
+	"rate-limiter/storage"
+)
+
+func setupTestHandler(limiter *limiter.RateLimiter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return RateLimitHandler(limiter)(mux)
+}
+
+func newTestRateLimiter(ipLimit int, tokenLimit int) (*limiter.RateLimiter, *storage.MockStorage) {
+	mockStorage := storage.NewMockStorage()
+	config := &limiter.Config{
+		IPLimit:            ipLimit,
+		IPBlockDuration:    300,
+		TokenLimit:         tokenLimit,
+		TokenBlockDuration: 300,
+	}
+	return limiter.NewRateLimiter(mockStorage, config), mockStorage
+}
+
+func TestRateLimitHandler_AllowAndBlock(t *testing.T) {
+	rateLimiter, _ := newTestRateLimiter(1, 10)
+	handler := setupTestHandler(rateLimiter)
+
+	req1 := httptest.NewRequest("GET", "/test", nil)
+	req1.RemoteAddr = "192.168.1.1:12345"
+	w1 := httptest.NewRecorder()
+	handler.ServeHTTP(w1, req1)
+
+	if w1.Code != http.StatusOK {
+		t.Errorf("First request should be allowed, got status %d", w1.Code)
+	}
+	if w1.Header().Get("X-RateLimit-Limit") != "1" || w1.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected rate limit headers %v", w1.Header())
+	}
+
+	req2 := httptest.NewRequest("GET", "/test", nil)
+	req2.RemoteAddr = "192.168.1.1:12345"
+	w2 := httptest.NewRecorder()
+	handler.ServeHTTP(w2, req2)
+
+	if w2.Code != http.StatusTooManyRequests {
+		t.Errorf("Second request should be blocked, got status %d", w2.Code)
+	}
+	if w2.Header().Get("Retry-After") != "300" {
+		t.Errorf("Expected Retry-After 300, got %q", w2.Header().Get("Retry-After"))
+	}
+
+	var body map[string]string
+	json.NewDecoder(w2.Body).Decode(&body)
+	if body["error"] != limiter.LimitExceededMessage {
+		t.Errorf("Unexpected error body %v", body)
+	}
+}
+
+func TestRateLimitHandler_TokenBased(t *testing.T) {
+	rateLimiter, _ := newTestRateLimiter(1, 2)
+	handler := setupTestHandler(rateLimiter)
+
+	codes := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, expected := range codes {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("API_KEY", "test-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != expected {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, expected, w.Code)
+		}
+	}
+}
+
+func TestRateLimitHandler_BlockedIP(t *testing.T) {
+	rateLimiter, mockStorage := newTestRateLimiter(5, 10)
+	mockStorage.SetBlocked("ip:192.168.1.1", true)
+	handler := setupTestHandler(rateLimiter)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.Header.Set("API_KEY", "test-token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Request from blocked IP should be blocked, got status %d", w.Code)
+	}
+}
+
+func TestRateLimitHandler_StorageError(t *testing.T) {
+	config := &limiter.Config{IPLimit: 5, IPBlockDuration: 300, TokenLimit: 10, TokenBlockDuration: 300}
+	handler := setupTestHandler(limiter.NewRateLimiter(&failingStorage{}, config))
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+}
+
+func TestRateLimitHandler_Cost(t *testing.T) {
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), &limiter.Config{
+		IPLimit:         10,
+		IPBlockDuration: 300,
+		RouteCosts:      []limiter.RouteCost{{Method: "POST", Path: "/export", Cost: 8}},
+	})
+	pageSize := func(r *http.Request) int {
+		size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+		return size / 10
+	}
+	handler := RateLimitHandler(rateLimiter, WithCost(pageSize))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method, target, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = ip + ":12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("POST", "/export", "192.168.1.1"); w.Header().Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("Route cost should be charged, got remaining %s", w.Header().Get("X-RateLimit-Remaining"))
+	}
+	if w := serve("POST", "/export", "192.168.1.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", w.Code)
+	}
+
+	if w := serve("GET", "/items?page_size=50", "192.168.1.2"); w.Header().Get("X-RateLimit-Remaining") != "5" {
+		t.Errorf("Hook cost should be charged, got remaining %s", w.Header().Get("X-RateLimit-Remaining"))
+	}
+	if w := serve("GET", "/items", "192.168.1.2"); w.Header().Get("X-RateLimit-Remaining") != "4" {
+		t.Errorf("Default cost should be 1, got remaining %s", w.Header().Get("X-RateLimit-Remaining"))
+	}
+}
+
+type failingStorage struct {
+	storage.MockStorage
+}
+
+func (f *failingStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return false, context.DeadlineExceeded
+}
+
+func TestRateLimitHandler_AccessLists(t *testing.T) {
+	config := &limiter.Config{
+		IPLimit:            1,
+		IPBlockDuration:    300,
+		TokenLimit:         1,
+		TokenBlockDuration: 300,
+		Allowlist:          []string{"10.0.0.0/8"},
+		Denylist:           []string{"203.0.113.0/24"},
+	}
+	handler := setupTestHandler(limiter.NewRateLimiter(storage.NewMockStorage(), config))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "10.0.0.5:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Request %d: expected allowlisted IP to pass, got status %d", i+1, w.Code)
+		}
+		if w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Errorf("Expected no rate limit headers, got %v", w.Header())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "203.0.113.50:12345"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected denylisted IP to get 403, got status %d", w.Code)
+	}
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["error"] != limiter.AccessDeniedMessage {
+		t.Errorf("Unexpected error body %v", body)
+	}
+}
+
+func TestRateLimitHandler_Concurrency(t *testing.T) {
+	memoryStorage := storage.NewMemoryStorage(storage.MemoryOptions{})
+	defer memoryStorage.Close()
+	config := &limiter.Config{
+		IPLimit:            10,
+		IPBlockDuration:    300,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+		ConcurrencyLimit:   1,
+		Rules: map[string]limiter.Rule{
+			"all_global": {Name: "all_global", Limit: 10, BlockDuration: 60, Route: limiter.Route{Path: "/*"}, Global: true},
+		},
+	}
+	rateLimiter := limiter.NewRateLimiter(memoryStorage, config)
+
+	entered := make(chan struct{})
+	finish := make(chan struct{})
+	handler := RateLimitHandler(rateLimiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-finish
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/slow", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-entered
+
+	req := httptest.NewRequest("GET", "/fast", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 while a request is in flight, got %d", w.Code)
+	}
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["error"] != limiter.ConcurrencyExceededMessage {
+		t.Errorf("Unexpected error body %v", body)
+	}
+	if count, _ := memoryStorage.GetCounter(context.Background(), "ip:192.168.1.1"); count != 1 {
+		t.Errorf("Expected the rejected request to be refunded, got count %d", count)
+	}
+	if count, _ := memoryStorage.GetCounter(context.Background(), "all_global:global"); count != 1 {
+		t.Errorf("Expected the rejected request to be refunded globally, got count %d", count)
+	}
+
+	close(finish)
+	<-done
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 once the slot is released, got %d", w.Code)
+	}
+}
+
+func TestRateLimitHandler_RouteRules(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &limiter.Config{
+		IPLimit:            10,
+		IPBlockDuration:    300,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+		Rules: map[string]limiter.Rule{
+			"test_global": {Name: "test_global", Limit: 2, BlockDuration: 5, Route: limiter.Route{Path: "/test"}, Global: true},
+			"test":        {Name: "test", Limit: 1, BlockDuration: 60, Route: limiter.Route{Path: "/test"}},
+		},
+	}
+	handler := setupTestHandler(limiter.NewRateLimiter(mockStorage, config))
+
+	tests := []struct {
+		ip      string
+		code    int
+		scope   string
+		message string
+	}{
+		{"192.168.1.1", http.StatusOK, "", ""},
+		{"192.168.1.1", http.StatusTooManyRequests, "client", limiter.LimitExceededMessage},
+		{"192.168.1.2", http.StatusOK, "", ""},
+		{"192.168.1.3", http.StatusTooManyRequests, "global", limiter.GlobalLimitExceededMessage},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = tt.ip + ":12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, tt.code, w.Code)
+		}
+		if scope := w.Header().Get("X-RateLimit-Scope"); scope != tt.scope {
+			t.Errorf("Request %d: expected scope %q, got %q", i+1, tt.scope, scope)
+		}
+		var body map[string]string
+		json.NewDecoder(w.Body).Decode(&body)
+		if body["error"] != tt.message {
+			t.Errorf("Request %d: unexpected error body %v", i+1, body)
+		}
+	}
+
+	if count, _ := mockStorage.GetCounter(context.Background(), "ip:192.168.1.3"); count != 0 {
+		t.Errorf("Expected the globally limited request to be refunded, got count %d", count)
+	}
+}
+
+func TestRateLimitHandler_Adaptive(t *testing.T) {
+	config := &limiter.Config{
+		IPLimit:           100,
+		IPBlockDuration:   300,
+		TokenLimit:        100,
+		AdaptiveErrorRate: 0.5,
+		AdaptiveInterval:  time.Nanosecond,
+	}
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+	handler := RateLimitHandler(rateLimiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "/fail", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.168.1.2:12345"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Header().Get("X-RateLimit-Limit") != "80" {
+		t.Errorf("Expected failing responses to cut the limit to 80, got %q", w.Header().Get("X-RateLimit-Limit"))
+	}
+	if stats := rateLimiter.AdaptiveStats(); stats.ErrorRate != 1 || stats.Decreases != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestRateLimitHandler_Shedding(t *testing.T) {
+	config := &limiter.Config{
+		IPLimit:            1,
+		IPBlockDuration:    300,
+		TokenLimit:         100,
+		TokenBlockDuration: 300,
+		ShedCapacity:       4,
+		PriorityClasses: []limiter.PriorityClass{
+			{Name: "anonymous", ShedAt: 0.5},
+			{Name: "enterprise"},
+		},
+		AnonymousPriority: "anonymous",
+		Allowlist:         []string{"192.168.1.9"},
+	}
+	resolver, _ := NewIPResolver(ProxyOptions{TrustedProxies: []string{"10.0.0.1"}})
+	handler := RateLimitHandler(limiter.NewRateLimiter(storage.NewMockStorage(), config),
+		WithIPResolver(resolver),
+		WithPriorityHeader("X-Priority"),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		peer     string
+		priority string
+		code     int
+	}{
+		{"192.168.1.1", "", http.StatusOK},
+		// Rejected by the limits first, so not counted as load.
+		{"192.168.1.1", "", http.StatusTooManyRequests},
+		{"192.168.1.2", "", http.StatusOK},
+		{"192.168.1.3", "", http.StatusServiceUnavailable},
+		{"192.168.1.4", "enterprise", http.StatusServiceUnavailable},
+		{"192.168.1.9", "", http.StatusOK},
+		{"10.0.0.1", "enterprise", http.StatusOK},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = tt.peer + ":12345"
+		if tt.priority != "" {
+			req.Header.Set("X-Priority", tt.priority)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, tt.code, w.Code)
+		}
+		if tt.code == http.StatusServiceUnavailable {
+			var body map[string]string
+			json.NewDecoder(w.Body).Decode(&body)
+			if body["error"] != limiter.LoadShedMessage || w.Header().Get("Retry-After") != "1" {
+				t.Errorf("Request %d: unexpected response %v %v", i+1, w.Header(), body)
+			}
+		}
+	}
+}
+
+func TestRateLimitHandler_DryRun(t *testing.T) {
+	config := &limiter.Config{
+		IPLimit:            10,
+		IPBlockDuration:    300,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+		Rules: map[string]limiter.Rule{
+			"test_new": {Name: "test_new", Limit: 1, BlockDuration: 60, Route: limiter.Route{Path: "/test"}, DryRun: true},
+		},
+	}
+	handler := setupTestHandler(limiter.NewRateLimiter(storage.NewMockStorage(), config))
+
+	for i, expected := range []string{"", "test_new", "test_new"} {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Request %d: expected the dry-run rule to let it through, got status %d", i+1, w.Code)
+		}
+		if dryRun := w.Header().Get("X-RateLimit-Dry-Run"); dryRun != expected {
+			t.Errorf("Request %d: expected X-RateLimit-Dry-Run %q, got %q", i+1, expected, dryRun)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"rate-limiter/limiter"
+)
+
+// WithPriority computes the priority class of each request, e.g. from the
+// plan of its account. An empty result falls back to WithPriorityHeader and
+// then to the limiter's configured classification.
+func WithPriority(priority func(r *http.Request) string) Option {
+	return func(o *options) {
+		o.priority = priority
+	}
+}
+
+// WithPriorityHeader reads the priority class of each request from header,
+// e.g. set by an API gateway that knows the client's plan. Like client IP
+// headers, it is only believed from trusted proxies.
+func WithPriorityHeader(header string) Option {
+	return func(o *options) {
+		o.priorityHeader = header
+	}
+}
+
+// shedRequest sheds r when the service is over the capacity open to its
+// priority class. It runs after every other check, so only requests the
+// limits admitted count as load. When the request must not proceed it writes
+// the error response, refunds what checkRequest charged and returns false.
+func shedRequest(rateLimiter *limiter.RateLimiter, o *options, w http.ResponseWriter, r *http.Request, charged charge) bool {
+	ip, token := o.ipResolver.ClientIP(r), r.Header.Get(tokenHeader)
+
+	decision, err := rateLimiter.Shed(r.Context(), ip, token, o.requestPriority(rateLimiter, r))
+	if err == nil && !decision.Shed {
+		return true
+	}
+
+	refund(rateLimiter, r, ip, token, charged)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal server error")
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(decision.RetryAfter))
+	writeError(w, http.StatusServiceUnavailable, limiter.LoadShedMessage)
+	return false
+}
+
+func (o *options) requestPriority(rateLimiter *limiter.RateLimiter, r *http.Request) string {
+	if o.priority != nil {
+		if class := o.priority(r); class != "" {
+			return class
+		}
+	}
+	if o.priorityHeader != "" && o.ipResolver.fromTrustedProxy(r) {
+		if class := r.Header.Get(o.priorityHeader); class != "" {
+			return class
+		}
+	}
+	return rateLimiter.Priority(r.Method, r.URL.Path, r.Header.Get(tokenHeader))
+}
@@ -1,35 +1,41 @@
 package middleware
 
 import (
-	"net/http"
+	"context"
+	"time"
 
 	"rate-limiter/limiter"
 
 	"github.com/gin-gonic/gin"
 )
 
-func RateLimitMiddleware(limiter *limiter.RateLimiter) gin.HandlerFunc {
+func RateLimitMiddleware(limiter *limiter.RateLimiter, opts ...Option) gin.HandlerFunc {
+	o := newOptions(opts)
 	return func(c *gin.Context) {
-		ip := c.ClientIP()
-		token := c.GetHeader("API_KEY")
-
-		limited, err := limiter.CheckRateLimit(c.Request.Context(), ip, token)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Internal server error",
-			})
+		charged, ok := checkRequest(limiter, o, c.Writer, c.Request)
+		if !ok {
 			c.Abort()
 			return
 		}
-
-		if limited {
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "you have reached the maximum number of requests or actions allowed within a certain time frame",
-			})
+		lease, ok := acquireSlot(limiter, o, c.Writer, c.Request, charged)
+		if !ok {
+			c.Abort()
+			return
+		}
+		defer lease.Release(context.WithoutCancel(c.Request.Context()))
+		if !shedRequest(limiter, o, c.Writer, c.Request, charged) {
 			c.Abort()
 			return
 		}
 
+		start := time.Now()
 		c.Next()
+
+		recordResponse(limiter, o, ResponseInfo{
+			Request: c.Request,
+			Status:  c.Writer.Status(),
+			Bytes:   int64(max(c.Writer.Size(), 0)),
+			Latency: time.Since(start),
+		}, charged.client)
 	}
 }
@@ -201,3 +201,28 @@ func TestRateLimitMiddleware_ClientIPExtraction(t *testing.T) {
 		t.Errorf("Request should be allowed, got status %d", w2.Code)
 	}
 }
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := &limiter.Config{
+		IPLimit:            3,
+		IPBlockDuration:    300,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+	}
+
+	rateLimiter := limiter.NewRateLimiter(mockStorage, config)
+	router := setupTestRouter(rateLimiter)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Header().Get("X-RateLimit-Limit") != "3" {
+		t.Errorf("Expected X-RateLimit-Limit 3, got %q", w.Header().Get("X-RateLimit-Limit"))
+	}
+	if w.Header().Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("Expected X-RateLimit-Remaining 2, got %q", w.Header().Get("X-RateLimit-Remaining"))
+	}
+}
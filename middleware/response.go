@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"rate-limiter/limiter"
+)
+
+// ResponseInfo describes a handled request to a WithResponseCost function.
+type ResponseInfo struct {
+	Request *http.Request
+	Status  int
+	Bytes   int64
+	Latency time.Duration
+}
+
+// WithResponseCost charges each request after the handler runs, with the cost
+// computed from the response. Before the handler the request is only checked
+// against what is left of the limit, unless WithPrecharge is also given.
+func WithResponseCost(cost func(info ResponseInfo) int) Option {
+	return func(o *options) {
+		o.responseCost = cost
+	}
+}
+
+// WithPrecharge charges the request cost before the handler runs, as without
+// WithResponseCost, and afterwards charges or refunds the difference to the
+// response cost.
+func WithPrecharge() Option {
+	return func(o *options) {
+		o.precharge = true
+	}
+}
+
+// CountStatus costs 1 for responses with a status between min and max, e.g.
+// CountStatus(400, 499) to count only failed logins, and nothing otherwise.
+func CountStatus(min, max int) func(info ResponseInfo) int {
+	return func(info ResponseInfo) int {
+		if info.Status >= min && info.Status <= max {
+			return 1
+		}
+		return 0
+	}
+}
+
+// CostPerBytes costs 1 per started unit of response bytes, at least 1.
+func CostPerBytes(unit int64) func(info ResponseInfo) int {
+	return func(info ResponseInfo) int {
+		return int(1 + max(info.Bytes-1, 0)/unit)
+	}
+}
+
+// CostPerLatency costs 1 per started unit of handler latency, at least 1.
+func CostPerLatency(unit time.Duration) func(info ResponseInfo) int {
+	return func(info ResponseInfo) int {
+		return int(1 + max(info.Latency-1, 0)/unit)
+	}
+}
+
+// recordResponse feeds the adaptive limits with a handled request and charges
+// its response cost, minus what was charged before the handler.
+func recordResponse(rateLimiter *limiter.RateLimiter, o *options, info ResponseInfo, charged int) {
+	rateLimiter.Observe(info.Latency, info.Status >= http.StatusInternalServerError)
+	if o.responseCost == nil {
+		return
+	}
+	cost := max(o.responseCost(info), 0)
+
+	r := info.Request
+	// The response is already sent: the error cannot be reported, and the
+	// client going away must not skip the charge.
+	rateLimiter.RecordN(context.WithoutCancel(r.Context()), o.ipResolver.ClientIP(r), r.Header.Get(tokenHeader), cost-charged)
+}
+
+// responseRecorder captures the status and size of a net/http response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/limiter"
+	"rate-limiter/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func serveFrom(handler http.Handler, method, target, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = ip + ":12345"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestResponseCost_CountStatus(t *testing.T) {
+	rateLimiter, _ := newTestRateLimiter(2, 10)
+	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("welcome"))
+	})
+	handler := RateLimitHandler(rateLimiter, WithResponseCost(CountStatus(400, 499)))(login)
+
+	for i := 0; i < 5; i++ {
+		if w := serveFrom(handler, "POST", "/login?password=secret", "192.168.1.1"); w.Code != http.StatusOK {
+			t.Fatalf("Successful logins should not count, got status %d", w.Code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := serveFrom(handler, "POST", "/login?password=wrong", "192.168.1.2"); w.Code != http.StatusUnauthorized {
+			t.Errorf("Failed login %d should reach the handler, got status %d", i+1, w.Code)
+		}
+	}
+	if w := serveFrom(handler, "POST", "/login?password=secret", "192.168.1.2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 after the failed logins, got %d", w.Code)
+	}
+}
+
+func TestResponseCost_PrechargeRefund(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	rateLimiter := limiter.NewRateLimiter(mockStorage, &limiter.Config{
+		IPLimit:         10,
+		IPBlockDuration: 300,
+		RouteCosts:      []limiter.RouteCost{{Path: "/search", Cost: 5}},
+	})
+	search := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	// Invalid searches are cheap: refund all but 1 unit.
+	cost := func(info ResponseInfo) int {
+		if info.Status == http.StatusBadRequest {
+			return 1
+		}
+		return 5
+	}
+	handler := RateLimitHandler(rateLimiter, WithResponseCost(cost), WithPrecharge())(search)
+
+	if w := serveFrom(handler, "GET", "/search", "192.168.1.1"); w.Header().Get("X-RateLimit-Remaining") != "5" {
+		t.Errorf("Expected the route cost to be precharged, got remaining %s", w.Header().Get("X-RateLimit-Remaining"))
+	}
+	if count, _ := mockStorage.GetCounter(context.Background(), "ip:192.168.1.1"); count != 1 {
+		t.Errorf("Expected the difference to be refunded, got count %d", count)
+	}
+
+	serveFrom(handler, "GET", "/search?q=go", "192.168.1.1")
+	if count, _ := mockStorage.GetCounter(context.Background(), "ip:192.168.1.1"); count != 6 {
+		t.Errorf("Expected the full cost to be kept, got count %d", count)
+	}
+}
+
+func TestResponseCost_Gin(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	rateLimiter := limiter.NewRateLimiter(mockStorage, &limiter.Config{IPLimit: 10, IPBlockDuration: 300})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RateLimitMiddleware(rateLimiter, WithResponseCost(CostPerBytes(10))))
+	router.GET("/download", func(c *gin.Context) {
+		c.String(http.StatusOK, strings.Repeat("x", 25))
+	})
+
+	serveFrom(router, "GET", "/download", "192.168.1.1")
+	if count, _ := mockStorage.GetCounter(context.Background(), "ip:192.168.1.1"); count != 3 {
+		t.Errorf("Expected 25 bytes to cost 3, got %d", count)
+	}
+}
+
+func TestResponseCostHelpers(t *testing.T) {
+	perKB := CostPerBytes(1024)
+	for bytes, expected := range map[int64]int{0: 1, 1: 1, 1024: 1, 1025: 2, 4096: 4} {
+		if cost := perKB(ResponseInfo{Bytes: bytes}); cost != expected {
+			t.Errorf("%d bytes: expected cost %d, got %d", bytes, expected, cost)
+		}
+	}
+
+	perSecond := CostPerLatency(time.Second)
+	if cost := perSecond(ResponseInfo{Latency: 2500 * time.Millisecond}); cost != 3 {
+		t.Errorf("Expected cost 3, got %d", cost)
+	}
+
+	serverErrors := CountStatus(500, 599)
+	if serverErrors(ResponseInfo{Status: 200}) != 0 || serverErrors(ResponseInfo{Status: 503}) != 1 {
+		t.Error("CountStatus should count only the given statuses")
+	}
+}
@@ -0,0 +1,183 @@
+package rls
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"rate-limiter/limiter"
+
+	ratelimitcommon "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Server implements Envoy's envoy.service.ratelimit.v3.RateLimitService on
+// top of a limiter.RateLimiter.
+//
+// Each descriptor is matched to a named rule. For the descriptor
+// [(generic_key, api), (remote_address, 10.0.0.1)] the rules
+// "generic_key=api.remote_address=10.0.0.1", "generic_key=api.remote_address"
+// and "generic_key.remote_address" are tried, in that order, and the counter
+// key is built from the domain and the entry values. A descriptor with a
+// limit override uses the override instead, and one without a matching rule is
+// always allowed.
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	rateLimiter *limiter.RateLimiter
+}
+
+func NewServer(rateLimiter *limiter.RateLimiter) *Server {
+	return &Server{rateLimiter: rateLimiter}
+}
+
+// Register registers the rate limit service on grpcServer.
+func Register(grpcServer *grpc.Server, rateLimiter *limiter.RateLimiter) {
+	rlsv3.RegisterRateLimitServiceServer(grpcServer, NewServer(rateLimiter))
+}
+
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one descriptor is required")
+	}
+
+	cost := int(req.GetHitsAddend())
+	if cost == 0 {
+		cost = 1
+	}
+
+	response := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	for _, descriptor := range req.GetDescriptors() {
+		descriptorStatus, err := s.check(ctx, req.GetDomain(), descriptor, cost)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Internal server error")
+		}
+		if descriptorStatus.Code == rlsv3.RateLimitResponse_OVER_LIMIT {
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		response.Statuses = append(response.Statuses, descriptorStatus)
+	}
+
+	return response, nil
+}
+
+func (s *Server) check(ctx context.Context, domain string, descriptor *ratelimitcommon.RateLimitDescriptor, cost int) (*rlsv3.RateLimitResponse_DescriptorStatus, error) {
+	rule, exists := s.rule(domain, descriptor)
+	if !exists {
+		return &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}, nil
+	}
+
+	values := make([]string, 0, len(descriptor.GetEntries()))
+	for _, entry := range descriptor.GetEntries() {
+		values = append(values, entry.GetValue())
+	}
+	key := domain + ":" + strings.Join(values, ":")
+
+	decision, err := s.rateLimiter.AllowN(ctx, rule, key, cost)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code: rlsv3.RateLimitResponse_OK,
+		CurrentLimit: &rlsv3.RateLimitResponse_RateLimit{
+			Name:            rule.Name,
+			RequestsPerUnit: uint32(decision.Limit),
+			Unit:            ruleUnit(rule),
+		},
+		LimitRemaining: uint32(decision.Remaining),
+	}
+	if decision.Limited {
+		descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+		descriptorStatus.DurationUntilReset = durationpb.New(time.Duration(decision.RetryAfter) * time.Second)
+	}
+	return descriptorStatus, nil
+}
+
+// rule finds the rule of descriptor, preferring its limit override. Override
+// rules are named after the domain and the descriptor keys under
+// limiter.OverrideRulePrefix, e.g. "rls:edge:tenant".
+func (s *Server) rule(domain string, descriptor *ratelimitcommon.RateLimitDescriptor) (limiter.Rule, bool) {
+	entries := descriptor.GetEntries()
+	if len(entries) == 0 {
+		return limiter.Rule{}, false
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.GetKey())
+	}
+
+	if override := descriptor.GetLimit(); override != nil && override.GetRequestsPerUnit() > 0 {
+		if seconds := unitSeconds(override.GetUnit()); seconds > 0 {
+			return limiter.Rule{
+				Name:          limiter.OverrideRulePrefix + domain + ":" + strings.Join(keys, "."),
+				Limit:         int(override.GetRequestsPerUnit()),
+				BlockDuration: seconds,
+			}, true
+		}
+	}
+
+	// The leading i entries are matched with their values, from the most
+	// specific name to the plain keys.
+	for i := len(entries); i >= 0; i-- {
+		parts := make([]string, len(entries))
+		for j, entry := range entries {
+			parts[j] = entry.GetKey()
+			if j < i {
+				parts[j] += "=" + entry.GetValue()
+			}
+		}
+		if rule, exists := s.rateLimiter.Rule(strings.Join(parts, ".")); exists {
+			return rule, true
+		}
+	}
+	return limiter.Rule{}, false
+}
+
+func unitSeconds(unit typev3.RateLimitUnit) int {
+	switch unit {
+	case typev3.RateLimitUnit_SECOND:
+		return 1
+	case typev3.RateLimitUnit_MINUTE:
+		return 60
+	case typev3.RateLimitUnit_HOUR:
+		return 3600
+	case typev3.RateLimitUnit_DAY:
+		return 86400
+	}
+	return 0
+}
+
+func ruleUnit(rule limiter.Rule) rlsv3.RateLimitResponse_RateLimit_Unit {
+	switch rule.Period {
+	case limiter.PeriodDay:
+		return rlsv3.RateLimitResponse_RateLimit_DAY
+	case limiter.PeriodMonth:
+		return rlsv3.RateLimitResponse_RateLimit_MONTH
+	}
+	return responseUnit(rule.BlockDuration)
+}
+
+// responseUnit reports a window of seconds as an Envoy unit when it matches
+// one exactly.
+func responseUnit(seconds int) rlsv3.RateLimitResponse_RateLimit_Unit {
+	switch seconds {
+	case 1:
+		return rlsv3.RateLimitResponse_RateLimit_SECOND
+	case 60:
+		return rlsv3.RateLimitResponse_RateLimit_MINUTE
+	case 3600:
+		return rlsv3.RateLimitResponse_RateLimit_HOUR
+	case 86400:
+		return rlsv3.RateLimitResponse_RateLimit_DAY
+	}
+	return rlsv3.RateLimitResponse_RateLimit_UNKNOWN
+}
@@ -0,0 +1,183 @@
+package rls
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"rate-limiter/limiter"
+	"rate-limiter/storage"
+
+	ratelimitcommon "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestRateLimiter(store storage.Storage) *limiter.RateLimiter {
+	config := &limiter.Config{
+		Rules: map[string]limiter.Rule{
+			"remote_address":          {Name: "remote_address", Limit: 2, BlockDuration: 60},
+			"generic_key=export.user": {Name: "generic_key=export.user", Limit: 1, BlockDuration: 3600},
+			"generic_key.user":        {Name: "generic_key.user", Limit: 100, BlockDuration: 60},
+		},
+	}
+	return limiter.NewRateLimiter(store, config)
+}
+
+// newTestClient serves the rate limit service over an in-memory connection.
+func newTestClient(t *testing.T, rateLimiter *limiter.RateLimiter) rlsv3.RateLimitServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	Register(grpcServer, rateLimiter)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(entries ...string) *ratelimitcommon.RateLimitDescriptor {
+	d := &ratelimitcommon.RateLimitDescriptor{}
+	for i := 0; i+1 < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitcommon.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return d
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	client := newTestClient(t, newTestRateLimiter(storage.NewMockStorage()))
+	ctx := context.Background()
+	req := &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.ShouldRateLimit(ctx, req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.OverallCode != rlsv3.RateLimitResponse_OK {
+			t.Errorf("Request %d should be allowed, got %v", i+1, resp.OverallCode)
+		}
+		st := resp.Statuses[0]
+		if st.CurrentLimit.RequestsPerUnit != 2 || st.CurrentLimit.Unit != rlsv3.RateLimitResponse_RateLimit_MINUTE {
+			t.Errorf("Unexpected current limit: %v", st.CurrentLimit)
+		}
+		if st.LimitRemaining != uint32(1-i) {
+			t.Errorf("Expected %d remaining, got %d", 1-i, st.LimitRemaining)
+		}
+	}
+
+	resp, _ := client.ShouldRateLimit(ctx, req)
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Third request should be over limit, got %v", resp.OverallCode)
+	}
+	if reset := resp.Statuses[0].DurationUntilReset.AsDuration(); reset != time.Minute {
+		t.Errorf("Expected reset in 1m, got %v", reset)
+	}
+
+	// Other domains have their own counters.
+	req.Domain = "internal"
+	if resp, _ := client.ShouldRateLimit(ctx, req); resp.OverallCode != rlsv3.RateLimitResponse_OK {
+		t.Errorf("Other domains should not be limited, got %v", resp.OverallCode)
+	}
+}
+
+func TestShouldRateLimit_PerDescriptorStatuses(t *testing.T) {
+	client := newTestClient(t, newTestRateLimiter(storage.NewMockStorage()))
+	req := &rlsv3.RateLimitRequest{
+		Domain: "edge",
+		Descriptors: []*ratelimitcommon.RateLimitDescriptor{
+			descriptor("generic_key", "export", "user", "u1"),
+			descriptor("generic_key", "search", "user", "u1"),
+			descriptor("unknown", "x"),
+		},
+		HitsAddend: 2,
+	}
+
+	resp, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected over limit, got %v", resp.OverallCode)
+	}
+	if len(resp.Statuses) != 3 {
+		t.Fatalf("Expected 3 statuses, got %d", len(resp.Statuses))
+	}
+
+	if resp.Statuses[0].Code != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Value-specific rule should be over limit, got %v", resp.Statuses[0].Code)
+	}
+	if st := resp.Statuses[1]; st.Code != rlsv3.RateLimitResponse_OK || st.CurrentLimit.Name != "generic_key.user" || st.LimitRemaining != 98 {
+		t.Errorf("Key rule should count the hits addend, got %v", st)
+	}
+	if st := resp.Statuses[2]; st.Code != rlsv3.RateLimitResponse_OK || st.CurrentLimit != nil {
+		t.Errorf("Descriptors without a rule should be allowed, got %v", st)
+	}
+}
+
+func TestShouldRateLimit_LimitOverride(t *testing.T) {
+	client := newTestClient(t, newTestRateLimiter(storage.NewMockStorage()))
+	d := descriptor("tenant", "acme")
+	d.Limit = &ratelimitcommon.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 1, Unit: typev3.RateLimitUnit_HOUR}
+	req := &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitcommon.RateLimitDescriptor{d}}
+
+	resp, _ := client.ShouldRateLimit(context.Background(), req)
+	if resp.OverallCode != rlsv3.RateLimitResponse_OK || resp.Statuses[0].CurrentLimit.Unit != rlsv3.RateLimitResponse_RateLimit_HOUR {
+		t.Errorf("Unexpected response: %v", resp)
+	}
+	if name := resp.Statuses[0].CurrentLimit.Name; name != "rls:edge:tenant" {
+		t.Errorf("Expected the override rule to be namespaced, got %q", name)
+	}
+	resp, _ = client.ShouldRateLimit(context.Background(), req)
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Override limit should apply, got %v", resp.OverallCode)
+	}
+}
+
+func TestShouldRateLimit_InvalidRequest(t *testing.T) {
+	client := newTestClient(t, newTestRateLimiter(storage.NewMockStorage()))
+
+	_, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{Domain: "edge"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestShouldRateLimit_StorageError(t *testing.T) {
+	client := newTestClient(t, newTestRateLimiter(&failingStorage{}))
+	req := &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	}
+
+	if _, err := client.ShouldRateLimit(context.Background(), req); status.Code(err) != codes.Internal {
+		t.Errorf("Expected Internal error, got %v", err)
+	}
+}
+
+type failingStorage struct {
+	storage.MockStorage
+}
+
+func (f *failingStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return false, context.DeadlineExceeded
+}
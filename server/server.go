@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net/http"
+
+	"rate-limiter/limiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CheckRequest is the body of POST /v1/check. Rule is one of Config.Rules:
+// the endpoint is not authenticated, so it cannot count against the "ip" and
+// "token" rules the middleware enforces. Cost defaults to 1 and cannot exceed
+// the rule's limit.
+type CheckRequest struct {
+	Key  string `json:"key"`
+	Cost int    `json:"cost"`
+	Rule string `json:"rule"`
+}
+
+// QuotaRequest is the body of POST /v1/quota. Without Rule every calendar
+// quota is returned.
+type QuotaRequest struct {
+	Key  string `json:"key"`
+	Rule string `json:"rule"`
+}
+
+// QuotaResponse is the response of POST /v1/quota and GET /v1/quota. The
+// caller's own API key is not echoed back.
+type QuotaResponse struct {
+	Key    string          `json:"key,omitempty"`
+	Quotas []limiter.Usage `json:"quotas"`
+}
+
+// RegisterRoutes exposes the rate limiter as a decision service, so services
+// written in any language can share its limits:
+//
+//	POST /v1/check {"key": "user-1", "cost": 1, "rule": "search"}
+//
+// answers 200 with the limiter.Decision, limited or not, and
+//
+//	POST /v1/quota {"key": "user-1", "rule": "api"}
+//
+// answers with the key's usage of every calendar quota, or only of rule. Keys
+// travel in the body rather than in the URL so they stay out of access logs.
+func RegisterRoutes(router gin.IRouter, rateLimiter *limiter.RateLimiter) {
+	router.POST("/v1/check", checkHandler(rateLimiter))
+	router.POST("/v1/quota", quotaHandler(rateLimiter))
+}
+
+// tokenHeader carries the API key, as in the middleware.
+const tokenHeader = "API_KEY"
+
+// RegisterUsageRoutes lets the clients of the middleware read the usage of
+// their own API key:
+//
+//	GET /v1/quota
+//	API_KEY: key-1
+//
+// answers with the key's usage of the "token" quota, and 404 when the token
+// limit has no period.
+func RegisterUsageRoutes(router gin.IRouter, rateLimiter *limiter.RateLimiter) {
+	router.GET("/v1/quota", usageHandler(rateLimiter))
+}
+
+func usageHandler(rateLimiter *limiter.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader(tokenHeader)
+		if token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "API_KEY header is required"})
+			return
+		}
+		rule, _ := rateLimiter.Rule("token")
+		if rule.Period == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no quota configured"})
+			return
+		}
+
+		usage, err := rateLimiter.Usage(c.Request.Context(), rule, token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, QuotaResponse{Quotas: []limiter.Usage{*usage}})
+	}
+}
+
+func checkHandler(rateLimiter *limiter.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CheckRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if req.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "key is required"})
+			return
+		}
+		if req.Cost == 0 {
+			req.Cost = 1
+		}
+		if req.Cost < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cost must be positive"})
+			return
+		}
+
+		rule, exists := rateLimiter.Rule(req.Rule)
+		if !exists || req.Rule == "ip" || req.Rule == "token" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown rule"})
+			return
+		}
+		if req.Cost > rule.Limit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cost exceeds the rule's limit"})
+			return
+		}
+
+		decision, err := rateLimiter.AllowN(c.Request.Context(), rule, req.Key, req.Cost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, decision)
+	}
+}
+
+func quotaHandler(rateLimiter *limiter.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req QuotaRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if req.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "key is required"})
+			return
+		}
+
+		rules := rateLimiter.Quotas()
+		if req.Rule != "" {
+			rule, exists := rateLimiter.Rule(req.Rule)
+			if !exists || rule.Period == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown quota"})
+				return
+			}
+			rules = []limiter.Rule{rule}
+		}
+
+		response := QuotaResponse{Key: req.Key, Quotas: []limiter.Usage{}}
+		for _, rule := range rules {
+			usage, err := rateLimiter.Usage(c.Request.Context(), rule, response.Key)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+				return
+			}
+			response.Quotas = append(response.Quotas, *usage)
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
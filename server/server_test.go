@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rate-limiter/limiter"
+	"rate-limiter/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func setupTestRouter(rateLimiter *limiter.RateLimiter) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	RegisterRoutes(router, rateLimiter)
+	return router
+}
+
+func newTestRateLimiter(store storage.Storage) *limiter.RateLimiter {
+	config := &limiter.Config{
+		IPLimit:            5,
+		IPBlockDuration:    300,
+		TokenLimit:         10,
+		TokenBlockDuration: 300,
+		Rules: map[string]limiter.Rule{
+			"search": {Name: "search", Limit: 3, BlockDuration: 60},
+			"api":    {Name: "api", Limit: 1000, Period: limiter.PeriodMonth},
+		},
+	}
+	return limiter.NewRateLimiter(store, config)
+}
+
+func postCheck(router *gin.Engine, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/v1/check", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func postQuota(router *gin.Engine, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/v1/quota", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCheck_Decision(t *testing.T) {
+	router := setupTestRouter(newTestRateLimiter(storage.NewMockStorage()))
+
+	w := postCheck(router, `{"key": "user-1", "cost": 2, "rule": "search"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var decision limiter.Decision
+	if err := json.Unmarshal(w.Body.Bytes(), &decision); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if decision.Limited || decision.Limit != 3 || decision.Remaining != 1 {
+		t.Errorf("Unexpected decision: %+v", decision)
+	}
+
+	w = postCheck(router, `{"key": "user-1", "cost": 2, "rule": "search"}`)
+	json.Unmarshal(w.Body.Bytes(), &decision)
+	if w.Code != http.StatusOK || !decision.Limited || decision.RetryAfter != 60 {
+		t.Errorf("Expected limited decision with status 200, got %d %+v", w.Code, decision)
+	}
+}
+
+func TestCheck_DefaultCost(t *testing.T) {
+	router := setupTestRouter(newTestRateLimiter(storage.NewMockStorage()))
+
+	w := postCheck(router, `{"key": "user-1", "rule": "search"}`)
+
+	var decision limiter.Decision
+	json.Unmarshal(w.Body.Bytes(), &decision)
+	if decision.Remaining != 2 {
+		t.Errorf("Expected 2 remaining, got %+v", decision)
+	}
+}
+
+func TestCheck_InvalidRequests(t *testing.T) {
+	router := setupTestRouter(newTestRateLimiter(storage.NewMockStorage()))
+
+	tests := []string{
+		`not json`,
+		`{"rule": "search"}`,
+		`{"key": "user-1", "cost": -1, "rule": "search"}`,
+		`{"key": "user-1", "rule": "missing"}`,
+		`{"key": "user-1"}`,
+		`{"key": "192.168.1.1", "rule": "ip"}`,
+		`{"key": "abc", "rule": "token"}`,
+		`{"key": "user-1", "cost": 4, "rule": "search"}`,
+	}
+	for _, body := range tests {
+		if w := postCheck(router, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+
+	// Rejected requests are not counted.
+	w := postCheck(router, `{"key": "user-1", "cost": 3, "rule": "search"}`)
+	var decision limiter.Decision
+	json.Unmarshal(w.Body.Bytes(), &decision)
+	if w.Code != http.StatusOK || decision.Limited {
+		t.Errorf("Expected the full limit to be left, got %d %+v", w.Code, decision)
+	}
+}
+
+func TestCheck_StorageError(t *testing.T) {
+	router := setupTestRouter(newTestRateLimiter(&failingStorage{}))
+
+	if w := postCheck(router, `{"key": "user-1", "rule": "search"}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+}
+
+func TestQuota_Usage(t *testing.T) {
+	router := setupTestRouter(newTestRateLimiter(storage.NewMockStorage()))
+
+	postCheck(router, `{"key": "key-1", "cost": 25, "rule": "api"}`)
+
+	w := postQuota(router, `{"key": "key-1"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var response QuotaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if response.Key != "key-1" || len(response.Quotas) != 1 {
+		t.Fatalf("Unexpected response: %+v", response)
+	}
+	usage := response.Quotas[0]
+	if usage.Rule != "api" || usage.Used != 25 || usage.Remaining != 975 || usage.ResetAt.Day() != 1 {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+
+	for _, body := range []string{`{"key": "key-1", "rule": "search"}`, `{"key": "key-1", "rule": "missing"}`, `{}`, `not json`} {
+		if w := postQuota(router, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestUsage_OwnKey(t *testing.T) {
+	config := &limiter.Config{IPLimit: 5, IPBlockDuration: 300, TokenLimit: 10, TokenPeriod: limiter.PeriodMonth}
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	RegisterUsageRoutes(router, rateLimiter)
+
+	rateLimiter.CheckN(context.Background(), "192.168.1.1", "key-1", 3)
+
+	getUsage := func(router *gin.Engine, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v1/quota", nil)
+		if token != "" {
+			req.Header.Set("API_KEY", token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := getUsage(router, "key-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var response QuotaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(response.Quotas) != 1 || response.Quotas[0].Rule != "token" || response.Quotas[0].Used != 3 {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+	if strings.Contains(w.Body.String(), "key-1") {
+		t.Error("Expected the API key not to be echoed back")
+	}
+
+	if w := getUsage(router, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without API_KEY, got %d", w.Code)
+	}
+
+	withoutQuota := gin.New()
+	RegisterUsageRoutes(withoutQuota, limiter.NewRateLimiter(storage.NewMockStorage(), &limiter.Config{TokenLimit: 10, TokenBlockDuration: 60}))
+	if w := getUsage(withoutQuota, "key-1"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 without a token period, got %d", w.Code)
+	}
+}
+
+type failingStorage struct {
+	storage.MockStorage
+}
+
+func (f *failingStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return false, context.DeadlineExceeded
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// blockCache remembers blocked keys in process until their block expires, so
+// repeated requests from an already blocked client skip the Redis lookup.
+type blockCache struct {
+	mutex   sync.Mutex
+	entries map[string]blockCacheEntry
+	size    int
+	now     func() time.Time
+}
+
+// blockCacheEntry is a cached block. Blocks without an expiry are cached
+// until expiresAt too, but their remaining time is unknown.
+type blockCacheEntry struct {
+	expiresAt time.Time
+	permanent bool
+}
+
+func newBlockCache(size int) *blockCache {
+	return &blockCache{
+		entries: make(map[string]blockCacheEntry),
+		size:    size,
+		now:     time.Now,
+	}
+}
+
+func (c *blockCache) blocked(key string) bool {
+	_, cached := c.ttl(key)
+	return cached
+}
+
+// ttl returns the time left before the cached block of key ends, zero for a
+// block without an expiry, and whether key is cached at all.
+func (c *blockCache) ttl(key string) (time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists {
+		return 0, false
+	}
+	now := c.now()
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return 0, false
+	}
+	if entry.permanent {
+		return 0, true
+	}
+	return entry.expiresAt.Sub(now), true
+}
+
+func (c *blockCache) add(key string, ttl time.Duration) {
+	c.put(key, ttl, false)
+}
+
+// addPermanent caches a block without an expiry for blockCacheMaxTTL.
+func (c *blockCache) addPermanent(key string) {
+	c.put(key, blockCacheMaxTTL, true)
+}
+
+func (c *blockCache) put(key string, ttl time.Duration, permanent bool) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+		for cachedKey, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, cachedKey)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return
+		}
+	}
+	c.entries[key] = blockCacheEntry{expiresAt: now.Add(ttl), permanent: permanent}
+}
+
+func (c *blockCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, key)
+}
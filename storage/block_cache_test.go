@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlockCache_Expiry(t *testing.T) {
+	cache := newBlockCache(10)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+
+	if cache.blocked("ip:192.168.1.1") {
+		t.Error("Expected unknown key to not be cached")
+	}
+
+	cache.add("ip:192.168.1.1", 30*time.Second)
+	if !cache.blocked("ip:192.168.1.1") {
+		t.Error("Expected key to be cached as blocked")
+	}
+
+	now = now.Add(30 * time.Second)
+	if cache.blocked("ip:192.168.1.1") {
+		t.Error("Expected cached block to expire with its TTL")
+	}
+}
+
+func TestBlockCache_TTL(t *testing.T) {
+	cache := newBlockCache(10)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+
+	cache.add("ip:192.168.1.1", 30*time.Second)
+	now = now.Add(10 * time.Second)
+	if ttl, cached := cache.ttl("ip:192.168.1.1"); !cached || ttl != 20*time.Second {
+		t.Errorf("Expected 20s left, got %v, %v", ttl, cached)
+	}
+
+	cache.addPermanent("ip:192.168.1.2")
+	if ttl, cached := cache.ttl("ip:192.168.1.2"); !cached || ttl != 0 {
+		t.Errorf("Expected a permanent block with no known TTL, got %v, %v", ttl, cached)
+	}
+	if _, cached := cache.ttl("ip:192.168.1.3"); cached {
+		t.Error("Expected unknown key to not be cached")
+	}
+}
+
+func TestBlockCache_Remove(t *testing.T) {
+	cache := newBlockCache(10)
+
+	cache.add("token:abc", time.Minute)
+	cache.remove("token:abc")
+
+	if cache.blocked("token:abc") {
+		t.Error("Expected key to be removed from cache")
+	}
+}
+
+func TestBlockCache_Size(t *testing.T) {
+	cache := newBlockCache(2)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+
+	cache.add("a", time.Second)
+	cache.add("b", time.Minute)
+	cache.add("c", time.Minute)
+	if cache.blocked("c") {
+		t.Error("Expected full cache to skip new keys")
+	}
+
+	now = now.Add(time.Second)
+	cache.add("c", time.Minute)
+	if !cache.blocked("c") {
+		t.Error("Expected expired entries to make room for new keys")
+	}
+}
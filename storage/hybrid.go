@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHybridFlushInterval = 100 * time.Millisecond
+
+// HybridBackend is the shared storage a HybridStorage synchronizes with.
+type HybridBackend interface {
+	Storage
+	TTLStorage
+}
+
+type HybridOptions struct {
+	// FlushInterval is how often local deltas are pushed to the backend.
+	FlushInterval time.Duration
+	// MaxDelta flushes a key synchronously as soon as it has that many
+	// unsynchronized increments. Zero disables the synchronous flush.
+	MaxDelta int64
+}
+
+// HybridOptionsFromEnv reads HybridOptions from the environment. Unset
+// variables keep their zero value; a variable that does not parse is an error
+// naming it.
+func HybridOptionsFromEnv() (HybridOptions, error) {
+	var env envParser
+	flushInterval := env.duration("HYBRID_FLUSH_INTERVAL")
+	maxDelta := env.int64("HYBRID_MAX_DELTA")
+	if env.err != nil {
+		return HybridOptions{}, env.err
+	}
+
+	return HybridOptions{
+		FlushInterval: flushInterval,
+		MaxDelta:      maxDelta,
+	}, nil
+}
+
+// HybridStorage counts increments locally and pushes the accumulated deltas
+// to a shared backend in batches, trading accuracy for one backend round trip
+// per key every FlushInterval (or every MaxDelta increments) instead of one
+// per request.
+//
+// Each instance sees its own increments immediately and the other instances'
+// increments only after its next flush. Once the shared count reaches the
+// limit, every instance notices at its next flush, so with N instances a key
+// can be allowed at most about (N+1)*MaxDelta requests over its limit per
+// window. With MaxDelta disabled the bound is time based instead: the
+// requests all instances receive for the key during one FlushInterval.
+// Blocks are not cached and always go to the backend.
+type HybridStorage struct {
+	remote   HybridBackend
+	opts     HybridOptions
+	mutex    sync.Mutex
+	counters map[string]*hybridCounter
+	now      func() time.Time
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// flushFailures counts the background flushes that failed.
+	flushFailures atomic.Int64
+}
+
+type hybridCounter struct {
+	mutex     sync.Mutex
+	loaded    bool
+	idle      bool
+	forgotten bool
+	base      int64
+	pending   int64
+	window    int
+	expiresAt time.Time
+}
+
+func NewHybridStorage(remote HybridBackend, opts HybridOptions) *HybridStorage {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultHybridFlushInterval
+	}
+
+	h := &HybridStorage{
+		remote:   remote,
+		opts:     opts,
+		counters: make(map[string]*hybridCounter),
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go h.flushLoop()
+
+	return h
+}
+
+func (h *HybridStorage) Increment(ctx context.Context, key string) (int64, error) {
+	return h.IncrementBy(ctx, key, 1)
+}
+
+func (h *HybridStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	c := h.lockedCounter(key)
+	defer c.mutex.Unlock()
+
+	if err := h.load(ctx, key, c); err != nil {
+		return 0, err
+	}
+
+	c.idle = false
+	c.pending += n
+	count := c.base + c.pending
+
+	if h.opts.MaxDelta > 0 && c.pending >= h.opts.MaxDelta {
+		// A failed flush keeps the delta pending for the next attempt.
+		h.flush(ctx, key, c)
+	}
+
+	return count, nil
+}
+
+func (h *HybridStorage) SetExpiration(ctx context.Context, key string, duration int) error {
+	h.mutex.Lock()
+	c, exists := h.counters[key]
+	h.mutex.Unlock()
+	if !exists {
+		return h.remote.SetExpiration(ctx, key, duration)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.forgotten {
+		return h.remote.SetExpiration(ctx, key, duration)
+	}
+
+	// The backend key may not exist until the first flush, which applies
+	// the window when it creates the key.
+	c.window = duration
+	c.expiresAt = h.now().Add(time.Duration(duration) * time.Second)
+	if c.pending == 0 {
+		return h.remote.SetExpiration(ctx, key, duration)
+	}
+	return nil
+}
+
+func (h *HybridStorage) GetCounter(ctx context.Context, key string) (int64, error) {
+	h.mutex.Lock()
+	c, exists := h.counters[key]
+	h.mutex.Unlock()
+
+	if exists {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.loaded && !c.expired(h.now()) {
+			return c.base + c.pending, nil
+		}
+	}
+	return h.remote.GetCounter(ctx, key)
+}
+
+// TTL returns the time left in the local window of key, or asks the backend
+// when key is not counted locally.
+func (h *HybridStorage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	h.mutex.Lock()
+	c, exists := h.counters[key]
+	h.mutex.Unlock()
+
+	if exists {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.loaded && !c.expiresAt.IsZero() && !c.expired(h.now()) {
+			return c.expiresAt.Sub(h.now()), nil
+		}
+	}
+	return h.remote.TTL(ctx, key)
+}
+
+func (h *HybridStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return h.remote.IsBlocked(ctx, key)
+}
+
+func (h *HybridStorage) Block(ctx context.Context, key string, duration int) error {
+	return h.remote.Block(ctx, key, duration)
+}
+
+// AddListEntry, RemoveListEntry and ListEntries go straight to the backend,
+// which must be a ListStorage.
+func (h *HybridStorage) AddListEntry(ctx context.Context, list string, entry string) error {
+	lists, err := h.lists()
+	if err != nil {
+		return err
+	}
+	return lists.AddListEntry(ctx, list, entry)
+}
+
+func (h *HybridStorage) RemoveListEntry(ctx context.Context, list string, entry string) error {
+	lists, err := h.lists()
+	if err != nil {
+		return err
+	}
+	return lists.RemoveListEntry(ctx, list, entry)
+}
+
+func (h *HybridStorage) ListEntries(ctx context.Context, list string) ([]string, error) {
+	lists, err := h.lists()
+	if err != nil {
+		return nil, err
+	}
+	return lists.ListEntries(ctx, list)
+}
+
+func (h *HybridStorage) lists() (ListStorage, error) {
+	lists, ok := h.remote.(ListStorage)
+	if !ok {
+		return nil, fmt.Errorf("hybrid backend does not support lists")
+	}
+	return lists, nil
+}
+
+// Acquire and Release go straight to the backend, which must be a
+// SemaphoreStorage.
+func (h *HybridStorage) Acquire(ctx context.Context, key string, holder string, limit int, lease time.Duration) (bool, error) {
+	semaphores, ok := h.remote.(SemaphoreStorage)
+	if !ok {
+		return false, fmt.Errorf("hybrid backend does not support semaphores")
+	}
+	return semaphores.Acquire(ctx, key, holder, limit, lease)
+}
+
+func (h *HybridStorage) Release(ctx context.Context, key string, holder string) error {
+	semaphores, ok := h.remote.(SemaphoreStorage)
+	if !ok {
+		return fmt.Errorf("hybrid backend does not support semaphores")
+	}
+	return semaphores.Release(ctx, key, holder)
+}
+
+// Flush pushes every pending delta to the backend. Deltas that fail to be
+// pushed stay pending for the next flush, and the first error is returned.
+func (h *HybridStorage) Flush(ctx context.Context) error {
+	h.mutex.Lock()
+	keys := make([]string, 0, len(h.counters))
+	counters := make([]*hybridCounter, 0, len(h.counters))
+	for key, c := range h.counters {
+		keys = append(keys, key)
+		counters = append(counters, c)
+	}
+	h.mutex.Unlock()
+
+	var firstErr error
+	for i, c := range counters {
+		c.mutex.Lock()
+		if c.idle && c.pending == 0 {
+			h.forget(keys[i], c)
+		} else if err := h.flush(ctx, keys[i], c); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to flush %q: %v", keys[i], err)
+			}
+		} else {
+			c.idle = true
+		}
+		c.mutex.Unlock()
+	}
+	return firstErr
+}
+
+// FlushFailures returns how many background flushes failed.
+func (h *HybridStorage) FlushFailures() int64 {
+	return h.flushFailures.Load()
+}
+
+// Close stops the background flush and pushes the remaining deltas,
+// returning the error of that last flush.
+func (h *HybridStorage) Close() error {
+	var err error
+	h.stopOnce.Do(func() {
+		close(h.stop)
+		<-h.done
+		err = h.Flush(context.Background())
+	})
+	return err
+}
+
+// flushLoop flushes every FlushInterval. Failures are counted, and logged
+// once when they start and once when flushes succeed again, so an
+// unavailable backend does not flood the log.
+func (h *HybridStorage) flushLoop() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.opts.FlushInterval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ticker.C:
+			err := h.Flush(context.Background())
+			switch {
+			case err != nil:
+				h.flushFailures.Add(1)
+				if !failing {
+					log.Printf("rate limiter: hybrid storage flush failed, retrying: %v", err)
+				}
+				failing = true
+			case failing:
+				log.Printf("rate limiter: hybrid storage flush recovered")
+				failing = false
+			}
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// lockedCounter returns the locked local counter of key, creating it if
+// needed.
+func (h *HybridStorage) lockedCounter(key string) *hybridCounter {
+	for {
+		h.mutex.Lock()
+		c, exists := h.counters[key]
+		if !exists {
+			c = &hybridCounter{}
+			h.counters[key] = c
+		}
+		h.mutex.Unlock()
+
+		c.mutex.Lock()
+		if !c.forgotten {
+			return c
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// load fetches the shared count the first time a key is used and again once
+// the local copy of its window has expired, dropping increments that belong
+// to the expired window. c must be locked.
+func (h *HybridStorage) load(ctx context.Context, key string, c *hybridCounter) error {
+	if c.loaded && !c.expired(h.now()) {
+		return nil
+	}
+
+	count, err := h.remote.GetCounter(ctx, key)
+	if err != nil {
+		return err
+	}
+	ttl, err := h.remote.TTL(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	c.loaded = true
+	c.base = count
+	c.pending = 0
+	c.expiresAt = time.Time{}
+	if ttl > 0 {
+		c.expiresAt = h.now().Add(ttl)
+	}
+	return nil
+}
+
+// flush pushes the pending delta of a single key. c must be locked.
+func (h *HybridStorage) flush(ctx context.Context, key string, c *hybridCounter) error {
+	if c.pending == 0 {
+		return nil
+	}
+
+	delta := c.pending
+	total, err := h.remote.IncrementBy(ctx, key, delta)
+	if err != nil {
+		return err
+	}
+
+	c.base = total
+	c.pending = 0
+
+	if total != delta {
+		return nil
+	}
+
+	// This flush created the key: start its window on the backend.
+	window := c.window
+	if window <= 0 && !c.expiresAt.IsZero() {
+		window = int(c.expiresAt.Sub(h.now())/time.Second) + 1
+	}
+	if window <= 0 {
+		return nil
+	}
+	c.expiresAt = h.now().Add(time.Duration(window) * time.Second)
+	return h.remote.SetExpiration(ctx, key, window)
+}
+
+// forget drops an idle key so its next use reloads the shared count. c must
+// be locked.
+func (h *HybridStorage) forget(key string, c *hybridCounter) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.counters[key] == c {
+		delete(h.counters, key)
+	}
+	c.forgotten = true
+}
+
+func (c *hybridCounter) expired(now time.Time) bool {
+	return !c.expiresAt.IsZero() && !now.Before(c.expiresAt)
+}
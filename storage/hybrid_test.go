@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestHybridStorage(t *testing.T, remote HybridBackend, opts HybridOptions) *HybridStorage {
+	h := NewHybridStorage(remote, opts)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestHybridStorage_CountsLocally(t *testing.T) {
+	remote := NewMemoryStorage(MemoryOptions{})
+	defer remote.Close()
+	h := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: time.Hour})
+	ctx := context.Background()
+
+	for i := int64(1); i <= 3; i++ {
+		count, err := h.Increment(ctx, "ip:192.168.1.1")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if count != i {
+			t.Errorf("Expected count %d, got %d", i, count)
+		}
+	}
+
+	if count, _ := remote.GetCounter(ctx, "ip:192.168.1.1"); count != 0 {
+		t.Errorf("Expected no remote increments before flush, got %d", count)
+	}
+
+	h.Flush(ctx)
+	if count, _ := remote.GetCounter(ctx, "ip:192.168.1.1"); count != 3 {
+		t.Errorf("Expected remote count 3 after flush, got %d", count)
+	}
+}
+
+func TestHybridStorage_ExpirationAppliedOnFlush(t *testing.T) {
+	remote := NewMemoryStorage(MemoryOptions{})
+	defer remote.Close()
+	h := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: time.Hour})
+	ctx := context.Background()
+
+	h.Increment(ctx, "ip:192.168.1.1")
+	if err := h.SetExpiration(ctx, "ip:192.168.1.1", 60); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	h.Flush(ctx)
+	ttl, _ := remote.TTL(ctx, "ip:192.168.1.1")
+	if ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected remote TTL of up to 60s, got %v", ttl)
+	}
+}
+
+func TestHybridStorage_SeesOtherInstancesAfterFlush(t *testing.T) {
+	remote := NewMemoryStorage(MemoryOptions{})
+	defer remote.Close()
+	a := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: time.Hour})
+	b := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: time.Hour})
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		a.Increment(ctx, "token:abc")
+	}
+	a.Flush(ctx)
+
+	count, _ := b.Increment(ctx, "token:abc")
+	if count != 6 {
+		t.Errorf("Expected count 6, got %d", count)
+	}
+}
+
+func TestHybridStorage_MaxDelta(t *testing.T) {
+	remote := NewMemoryStorage(MemoryOptions{})
+	defer remote.Close()
+	h := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: time.Hour, MaxDelta: 3})
+	ctx := context.Background()
+
+	h.Increment(ctx, "ip:192.168.1.1")
+	h.Increment(ctx, "ip:192.168.1.1")
+	if count, _ := remote.GetCounter(ctx, "ip:192.168.1.1"); count != 0 {
+		t.Errorf("Expected no remote increments below MaxDelta, got %d", count)
+	}
+
+	h.Increment(ctx, "ip:192.168.1.1")
+	if count, _ := remote.GetCounter(ctx, "ip:192.168.1.1"); count != 3 {
+		t.Errorf("Expected flush at MaxDelta, got remote count %d", count)
+	}
+}
+
+func TestHybridStorage_CloseFlushes(t *testing.T) {
+	remote := NewMemoryStorage(MemoryOptions{})
+	defer remote.Close()
+	h := NewHybridStorage(remote, HybridOptions{FlushInterval: time.Hour})
+	ctx := context.Background()
+
+	h.Increment(ctx, "ip:192.168.1.1")
+	h.Increment(ctx, "ip:192.168.1.1")
+	h.Close()
+
+	if count, _ := remote.GetCounter(ctx, "ip:192.168.1.1"); count != 2 {
+		t.Errorf("Expected pending increments to be flushed on close, got %d", count)
+	}
+}
+
+// unavailableBackend fails every increment while down.
+type unavailableBackend struct {
+	*MemoryStorage
+	down atomic.Bool
+}
+
+func (u *unavailableBackend) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	if u.down.Load() {
+		return 0, context.DeadlineExceeded
+	}
+	return u.MemoryStorage.IncrementBy(ctx, key, n)
+}
+
+func TestHybridStorage_FlushErrors(t *testing.T) {
+	remote := &unavailableBackend{MemoryStorage: NewMemoryStorage(MemoryOptions{})}
+	defer remote.Close()
+	h := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: time.Hour})
+	ctx := context.Background()
+
+	h.Increment(ctx, "ip:192.168.1.1")
+	h.Increment(ctx, "ip:192.168.1.1")
+
+	remote.down.Store(true)
+	if err := h.Flush(ctx); err == nil {
+		t.Fatal("Expected the flush error to be returned")
+	}
+
+	// The deltas stay pending until the backend is back.
+	remote.down.Store(false)
+	if err := h.Flush(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if count, _ := remote.GetCounter(ctx, "ip:192.168.1.1"); count != 2 {
+		t.Errorf("Expected the failed deltas to be flushed later, got remote count %d", count)
+	}
+
+	remote.down.Store(true)
+	h.Increment(ctx, "ip:192.168.1.1")
+	if err := h.Close(); err == nil {
+		t.Error("Expected Close to return the error of the last flush")
+	}
+}
+
+func TestHybridStorage_FlushLoopCountsFailures(t *testing.T) {
+	remote := &unavailableBackend{MemoryStorage: NewMemoryStorage(MemoryOptions{})}
+	defer remote.Close()
+	remote.down.Store(true)
+	h := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: 5 * time.Millisecond})
+	ctx := context.Background()
+
+	h.Increment(ctx, "ip:192.168.1.1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for h.FlushFailures() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected background flush failures to be counted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	remote.down.Store(false)
+}
+
+func TestHybridStorage_Overshoot(t *testing.T) {
+	const (
+		instances  = 4
+		goroutines = 8
+		requests   = 100
+		limit      = 200
+		maxDelta   = 5
+	)
+
+	remote := NewMemoryStorage(MemoryOptions{})
+	defer remote.Close()
+	ctx := context.Background()
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		h := newTestHybridStorage(t, remote, HybridOptions{FlushInterval: 5 * time.Millisecond, MaxDelta: maxDelta})
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r := 0; r < requests; r++ {
+					count, err := h.Increment(ctx, "ip:192.168.1.1")
+					if err != nil {
+						t.Errorf("Unexpected error: %v", err)
+						return
+					}
+					if count <= limit {
+						atomic.AddInt64(&allowed, 1)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	overshoot := allowed - limit
+	t.Logf("allowed %d requests for limit %d (overshoot %d)", allowed, limit, overshoot)
+
+	if allowed < limit {
+		t.Errorf("Expected at least %d allowed requests, got %d", limit, allowed)
+	}
+	if bound := int64((instances + 1) * maxDelta); overshoot > bound {
+		t.Errorf("Overshoot %d exceeds documented bound %d", overshoot, bound)
+	}
+}
@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemoryShards          = 32
+	defaultMemoryCleanupInterval = time.Minute
+)
+
+type MemoryOptions struct {
+	// MaxKeys caps the number of live keys; the least recently used key is
+	// evicted once the cap is reached. Zero means unlimited. The cap is split
+	// evenly between the shards, rounding up, so Shards is lowered to MaxKeys
+	// when it is greater.
+	MaxKeys         int
+	Shards          int
+	CleanupInterval time.Duration
+}
+
+// MemoryOptionsFromEnv reads MemoryOptions from the environment. Unset
+// variables keep their zero value; a variable that does not parse is an error
+// naming it.
+func MemoryOptionsFromEnv() (MemoryOptions, error) {
+	var env envParser
+	maxKeys := env.int("MEMORY_MAX_KEYS")
+	cleanupInterval := env.duration("MEMORY_CLEANUP_INTERVAL")
+	if env.err != nil {
+		return MemoryOptions{}, env.err
+	}
+
+	return MemoryOptions{
+		MaxKeys:         maxKeys,
+		CleanupInterval: cleanupInterval,
+	}, nil
+}
+
+// MemoryStorage is an in-process Storage for single-instance deployments.
+// It follows the Redis semantics the limiter relies on: counters are created
+// without a TTL, SetExpiration only applies to existing keys and blocks are
+// "<key>:blocked" entries that expire on their own.
+type MemoryStorage struct {
+	shards      []*memoryShard
+	maxPerShard int
+	now         func() time.Time
+	stopJanitor chan struct{}
+	stopOnce    sync.Once
+
+	listMutex sync.Mutex
+	lists     map[string]map[string]struct{}
+
+	semaphoreMutex sync.Mutex
+	semaphores     map[string]map[string]time.Time
+}
+
+type memoryShard struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	key       string
+	value     int64
+	expiresAt time.Time
+}
+
+func NewMemoryStorage(opts MemoryOptions) *MemoryStorage {
+	if opts.Shards <= 0 {
+		opts.Shards = defaultMemoryShards
+	}
+	if opts.MaxKeys > 0 && opts.Shards > opts.MaxKeys {
+		opts.Shards = opts.MaxKeys
+	}
+	if opts.CleanupInterval <= 0 {
+		opts.CleanupInterval = defaultMemoryCleanupInterval
+	}
+
+	m := &MemoryStorage{
+		shards:      make([]*memoryShard, opts.Shards),
+		now:         time.Now,
+		stopJanitor: make(chan struct{}),
+		lists:       make(map[string]map[string]struct{}),
+		semaphores:  make(map[string]map[string]time.Time),
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		}
+	}
+	if opts.MaxKeys > 0 {
+		m.maxPerShard = (opts.MaxKeys + opts.Shards - 1) / opts.Shards
+	}
+
+	go m.janitor(opts.CleanupInterval)
+
+	return m
+}
+
+func (m *MemoryStorage) Increment(ctx context.Context, key string) (int64, error) {
+	return m.IncrementBy(ctx, key, 1)
+}
+
+func (m *MemoryStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry := shard.get(key, m.now())
+	if entry == nil {
+		entry = shard.add(key, m.maxPerShard)
+	}
+	entry.value += n
+	return entry.value, nil
+}
+
+func (m *MemoryStorage) SetExpiration(ctx context.Context, key string, duration int) error {
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry := shard.get(key, m.now())
+	if entry == nil {
+		return nil
+	}
+	if duration <= 0 {
+		shard.remove(shard.entries[key])
+		return nil
+	}
+	entry.expiresAt = m.now().Add(time.Duration(duration) * time.Second)
+	return nil
+}
+
+func (m *MemoryStorage) GetCounter(ctx context.Context, key string) (int64, error) {
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if entry := shard.get(key, m.now()); entry != nil {
+		return entry.value, nil
+	}
+	return 0, nil
+}
+
+// TTL returns the time left before key expires, or zero when the key does
+// not exist or has no expiry.
+func (m *MemoryStorage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry := shard.get(key, m.now())
+	if entry == nil || entry.expiresAt.IsZero() {
+		return 0, nil
+	}
+	return entry.expiresAt.Sub(m.now()), nil
+}
+
+func (m *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	blockedKey := key + ":blocked"
+	shard := m.shard(blockedKey)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	return shard.get(blockedKey, m.now()) != nil, nil
+}
+
+func (m *MemoryStorage) Block(ctx context.Context, key string, duration int) error {
+	if duration <= 0 {
+		return nil
+	}
+	blockedKey := key + ":blocked"
+	shard := m.shard(blockedKey)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry := shard.get(blockedKey, m.now())
+	if entry == nil {
+		entry = shard.add(blockedKey, m.maxPerShard)
+	}
+	entry.value = 1
+	entry.expiresAt = m.now().Add(time.Duration(duration) * time.Second)
+	return nil
+}
+
+func (m *MemoryStorage) AddListEntry(ctx context.Context, list string, entry string) error {
+	m.listMutex.Lock()
+	defer m.listMutex.Unlock()
+
+	if m.lists[list] == nil {
+		m.lists[list] = make(map[string]struct{})
+	}
+	m.lists[list][entry] = struct{}{}
+	return nil
+}
+
+func (m *MemoryStorage) RemoveListEntry(ctx context.Context, list string, entry string) error {
+	m.listMutex.Lock()
+	defer m.listMutex.Unlock()
+
+	delete(m.lists[list], entry)
+	return nil
+}
+
+func (m *MemoryStorage) ListEntries(ctx context.Context, list string) ([]string, error) {
+	m.listMutex.Lock()
+	defer m.listMutex.Unlock()
+
+	entries := make([]string, 0, len(m.lists[list]))
+	for entry := range m.lists[list] {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (m *MemoryStorage) Acquire(ctx context.Context, key string, holder string, limit int, lease time.Duration) (bool, error) {
+	m.semaphoreMutex.Lock()
+	defer m.semaphoreMutex.Unlock()
+
+	now := m.now()
+	holders := m.semaphores[key]
+	if holders == nil {
+		holders = make(map[string]time.Time)
+		m.semaphores[key] = holders
+	}
+	for id, expiresAt := range holders {
+		if !now.Before(expiresAt) {
+			delete(holders, id)
+		}
+	}
+
+	if _, held := holders[holder]; !held && len(holders) >= limit {
+		return false, nil
+	}
+	holders[holder] = now.Add(lease)
+	return true, nil
+}
+
+func (m *MemoryStorage) Release(ctx context.Context, key string, holder string) error {
+	m.semaphoreMutex.Lock()
+	defer m.semaphoreMutex.Unlock()
+
+	delete(m.semaphores[key], holder)
+	if len(m.semaphores[key]) == 0 {
+		delete(m.semaphores, key)
+	}
+	return nil
+}
+
+// Len returns the number of keys currently held, including expired keys the
+// janitor has not swept yet.
+func (m *MemoryStorage) Len() int {
+	total := 0
+	for _, shard := range m.shards {
+		shard.mutex.Lock()
+		total += len(shard.entries)
+		shard.mutex.Unlock()
+	}
+	return total
+}
+
+func (m *MemoryStorage) Close() error {
+	m.stopOnce.Do(func() {
+		close(m.stopJanitor)
+	})
+	return nil
+}
+
+func (m *MemoryStorage) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+func (m *MemoryStorage) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.deleteExpired()
+		case <-m.stopJanitor:
+			return
+		}
+	}
+}
+
+func (m *MemoryStorage) deleteExpired() {
+	now := m.now()
+	for _, shard := range m.shards {
+		shard.mutex.Lock()
+		for _, element := range shard.entries {
+			if element.Value.(*memoryEntry).expired(now) {
+				shard.remove(element)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+func (s *memoryShard) get(key string, now time.Time) *memoryEntry {
+	element, exists := s.entries[key]
+	if !exists {
+		return nil
+	}
+	entry := element.Value.(*memoryEntry)
+	if entry.expired(now) {
+		s.remove(element)
+		return nil
+	}
+	s.lru.MoveToFront(element)
+	return entry
+}
+
+func (s *memoryShard) add(key string, maxKeys int) *memoryEntry {
+	if maxKeys > 0 {
+		for len(s.entries) >= maxKeys {
+			s.remove(s.lru.Back())
+		}
+	}
+	entry := &memoryEntry{key: key}
+	s.entries[key] = s.lru.PushFront(entry)
+	return entry
+}
+
+func (s *memoryShard) remove(element *list.Element) {
+	delete(s.entries, element.Value.(*memoryEntry).key)
+	s.lru.Remove(element)
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
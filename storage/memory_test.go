@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMemoryStorage(t *testing.T, opts MemoryOptions) (*MemoryStorage, *time.Time) {
+	m := NewMemoryStorage(opts)
+	t.Cleanup(func() { m.Close() })
+
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+func TestMemoryStorage_Increment(t *testing.T) {
+	m, _ := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	for i := int64(1); i <= 3; i++ {
+		count, err := m.Increment(ctx, "test-key")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if count != i {
+			t.Errorf("Expected count %d, got %d", i, count)
+		}
+	}
+
+	count, _ := m.Increment(ctx, "another-key")
+	if count != 1 {
+		t.Errorf("Expected count 1, got %d", count)
+	}
+}
+
+func TestMemoryStorage_Expiration(t *testing.T) {
+	m, now := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+	key := "test-key"
+
+	m.Increment(ctx, key)
+	m.Increment(ctx, key)
+	if err := m.SetExpiration(ctx, key, 10); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	*now = now.Add(9 * time.Second)
+	count, _ := m.GetCounter(ctx, key)
+	if count != 2 {
+		t.Errorf("Expected count 2 before expiry, got %d", count)
+	}
+
+	*now = now.Add(time.Second)
+	count, _ = m.GetCounter(ctx, key)
+	if count != 0 {
+		t.Errorf("Expected count 0 after expiry, got %d", count)
+	}
+
+	count, _ = m.Increment(ctx, key)
+	if count != 1 {
+		t.Errorf("Expected counter to restart at 1, got %d", count)
+	}
+}
+
+func TestMemoryStorage_SetExpirationMissingKey(t *testing.T) {
+	m, _ := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	if err := m.SetExpiration(ctx, "missing", 10); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if m.Len() != 0 {
+		t.Errorf("SetExpiration should not create keys, got %d keys", m.Len())
+	}
+}
+
+func TestMemoryStorage_IsBlocked(t *testing.T) {
+	m, now := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	blocked, _ := m.IsBlocked(ctx, "ip:192.168.1.1")
+	if blocked {
+		t.Error("Expected not blocked")
+	}
+
+	if err := m.Block(ctx, "ip:192.168.1.1", 60); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	blocked, _ = m.IsBlocked(ctx, "ip:192.168.1.1")
+	if !blocked {
+		t.Error("Expected blocked")
+	}
+
+	*now = now.Add(time.Minute)
+	blocked, _ = m.IsBlocked(ctx, "ip:192.168.1.1")
+	if blocked {
+		t.Error("Expected block to expire")
+	}
+}
+
+func TestMemoryStorage_LRUEviction(t *testing.T) {
+	m, _ := newTestMemoryStorage(t, MemoryOptions{MaxKeys: 2, Shards: 1})
+	ctx := context.Background()
+
+	m.Increment(ctx, "a")
+	m.Increment(ctx, "b")
+	m.GetCounter(ctx, "a")
+	m.Increment(ctx, "c")
+
+	if m.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %d", m.Len())
+	}
+	if count, _ := m.GetCounter(ctx, "b"); count != 0 {
+		t.Error("Least recently used key should have been evicted")
+	}
+	if count, _ := m.GetCounter(ctx, "a"); count != 1 {
+		t.Error("Recently used key should have been kept")
+	}
+}
+
+func TestMemoryStorage_MaxKeysBelowShards(t *testing.T) {
+	m, _ := newTestMemoryStorage(t, MemoryOptions{MaxKeys: 3})
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		m.Increment(ctx, fmt.Sprintf("key-%d", i))
+	}
+
+	if len(m.shards) != 3 {
+		t.Errorf("Expected the shards to be clamped to MaxKeys, got %d", len(m.shards))
+	}
+	if m.Len() > 3 {
+		t.Errorf("Expected at most 3 keys, got %d", m.Len())
+	}
+}
+
+func TestMemoryStorage_DeleteExpired(t *testing.T) {
+	m, now := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	m.Increment(ctx, "short")
+	m.SetExpiration(ctx, "short", 1)
+	m.Increment(ctx, "long")
+	m.SetExpiration(ctx, "long", 60)
+	m.Increment(ctx, "forever")
+
+	*now = now.Add(2 * time.Second)
+	m.deleteExpired()
+
+	if m.Len() != 2 {
+		t.Errorf("Expected 2 keys after cleanup, got %d", m.Len())
+	}
+}
+
+func TestMemoryStorage_Concurrency(t *testing.T) {
+	m := NewMemoryStorage(MemoryOptions{})
+	defer m.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Increment(ctx, "shared")
+				m.Increment(ctx, fmt.Sprintf("key-%d", i))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count, _ := m.GetCounter(ctx, "shared")
+	if count != 5000 {
+		t.Errorf("Expected count 5000, got %d", count)
+	}
+	if m.Len() != 51 {
+		t.Errorf("Expected 51 keys, got %d", m.Len())
+	}
+}
+
+func TestMemoryStorage_IncrementByAndTTL(t *testing.T) {
+	m, now := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	count, err := m.IncrementBy(ctx, "test-key", 5)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("Expected count 5, got %d", count)
+	}
+
+	if ttl, _ := m.TTL(ctx, "test-key"); ttl != 0 {
+		t.Errorf("Expected no TTL, got %v", ttl)
+	}
+
+	m.SetExpiration(ctx, "test-key", 60)
+	*now = now.Add(15 * time.Second)
+	if ttl, _ := m.TTL(ctx, "test-key"); ttl != 45*time.Second {
+		t.Errorf("Expected TTL 45s, got %v", ttl)
+	}
+}
+
+func TestMemoryStorage_Lists(t *testing.T) {
+	m, _ := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	m.AddListEntry(ctx, "denylist", "203.0.113.0/24")
+	m.AddListEntry(ctx, "denylist", "203.0.113.0/24")
+	m.AddListEntry(ctx, "denylist", "key:abc")
+	m.RemoveListEntry(ctx, "denylist", "key:abc")
+
+	entries, err := m.ListEntries(ctx, "denylist")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0] != "203.0.113.0/24" {
+		t.Errorf("Expected [203.0.113.0/24], got %v", entries)
+	}
+	if entries, _ := m.ListEntries(ctx, "allowlist"); len(entries) != 0 {
+		t.Errorf("Expected empty allowlist, got %v", entries)
+	}
+}
+
+func TestMemoryStorage_Semaphore(t *testing.T) {
+	m, now := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	for _, holder := range []string{"a", "b"} {
+		if acquired, _ := m.Acquire(ctx, "inflight:ip:1.2.3.4", holder, 2, 30*time.Second); !acquired {
+			t.Errorf("Expected %s to acquire a slot", holder)
+		}
+	}
+	if acquired, _ := m.Acquire(ctx, "inflight:ip:1.2.3.4", "c", 2, 30*time.Second); acquired {
+		t.Error("Expected no slot left")
+	}
+
+	// Renewing a held slot is not a new slot.
+	*now = now.Add(20 * time.Second)
+	if acquired, _ := m.Acquire(ctx, "inflight:ip:1.2.3.4", "a", 2, 30*time.Second); !acquired {
+		t.Error("Expected the holder to renew its slot")
+	}
+
+	// b's lease runs out; a's renewed one does not.
+	*now = now.Add(15 * time.Second)
+	if acquired, _ := m.Acquire(ctx, "inflight:ip:1.2.3.4", "c", 2, 30*time.Second); !acquired {
+		t.Error("Expected the expired lease to free its slot")
+	}
+	if acquired, _ := m.Acquire(ctx, "inflight:ip:1.2.3.4", "d", 2, 30*time.Second); acquired {
+		t.Error("Expected the renewed lease to keep its slot")
+	}
+
+	m.Release(ctx, "inflight:ip:1.2.3.4", "a")
+	if acquired, _ := m.Acquire(ctx, "inflight:ip:1.2.3.4", "d", 2, 30*time.Second); !acquired {
+		t.Error("Expected the released slot to be free")
+	}
+}
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"strings"
 	"sync"
+	"time"
 )
 
 type MockStorage struct {
@@ -28,6 +30,14 @@ func (m *MockStorage) Increment(ctx context.Context, key string) (int64, error)
 	return m.counters[key], nil
 }
 
+func (m *MockStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.counters[key] += n
+	return m.counters[key], nil
+}
+
 func (m *MockStorage) SetExpiration(ctx context.Context, key string, duration int) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -46,6 +56,18 @@ func (m *MockStorage) GetCounter(ctx context.Context, key string) (int64, error)
 	return 0, nil
 }
 
+// TTL returns the last expiration set on key, as the mock does not expire
+// keys.
+func (m *MockStorage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if key, found := strings.CutSuffix(key, ":blocked"); found && !m.blocked[key] {
+		return 0, nil
+	}
+	return time.Duration(m.expiry[key]) * time.Second, nil
+}
+
 func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -53,6 +75,18 @@ func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
 	return m.blocked[key], nil
 }
 
+func (m *MockStorage) Block(ctx context.Context, key string, duration int) error {
+	if duration <= 0 {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.blocked[key] = true
+	m.expiry[key+":blocked"] = duration
+	return nil
+}
+
 func (m *MockStorage) SetBlocked(key string, blocked bool) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -155,3 +155,36 @@ func TestMockStorage_Reset(t *testing.T) {
 		t.Error("Expected key to not be blocked after reset")
 	}
 }
+
+func TestMockStorage_Block(t *testing.T) {
+	mock := NewMockStorage()
+	ctx := context.Background()
+	key := "test-key"
+
+	if err := mock.Block(ctx, key, 300); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	blocked, _ := mock.IsBlocked(ctx, key)
+	if !blocked {
+		t.Error("Expected blocked")
+	}
+	if mock.expiry[key+":blocked"] != 300 {
+		t.Errorf("Expected block duration 300, got %d", mock.expiry[key+":blocked"])
+	}
+}
+
+func TestMockStorage_IncrementBy(t *testing.T) {
+	mock := NewMockStorage()
+	ctx := context.Background()
+	key := "test-key"
+
+	mock.Increment(ctx, key)
+	count, err := mock.IncrementBy(ctx, key, 4)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("Expected count 5, got %d", count)
+	}
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultPipelineMaxBatch = 100
+
+// autoPipeliner batches the commands issued by concurrent callers within a
+// short window into a single Redis pipeline, so N goroutines cost one round
+// trip instead of N.
+type autoPipeliner struct {
+	client   redis.UniversalClient
+	window   time.Duration
+	maxBatch int
+
+	mutex sync.Mutex
+	queue []*pipelinedCmd
+	timer *time.Timer
+
+	lookups flightGroup
+}
+
+type pipelinedCmd struct {
+	cmd  redis.Cmder
+	done chan struct{}
+}
+
+func newAutoPipeliner(client redis.UniversalClient, window time.Duration, maxBatch int) *autoPipeliner {
+	if maxBatch <= 0 {
+		maxBatch = defaultPipelineMaxBatch
+	}
+	return &autoPipeliner{
+		client:   client,
+		window:   window,
+		maxBatch: maxBatch,
+	}
+}
+
+// process queues cmd for the next pipeline and waits for its reply. If ctx
+// ends first the command is still sent, but its result is discarded.
+func (p *autoPipeliner) process(ctx context.Context, cmd redis.Cmder) error {
+	queued := &pipelinedCmd{cmd: cmd, done: make(chan struct{})}
+
+	p.mutex.Lock()
+	p.queue = append(p.queue, queued)
+	switch {
+	case len(p.queue) >= p.maxBatch:
+		batch := p.take()
+		p.mutex.Unlock()
+		p.exec(batch)
+	case len(p.queue) == 1:
+		p.timer = time.AfterFunc(p.window, p.flush)
+		p.mutex.Unlock()
+	default:
+		p.mutex.Unlock()
+	}
+
+	select {
+	case <-queued.done:
+		return cmd.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *autoPipeliner) flush() {
+	p.mutex.Lock()
+	batch := p.take()
+	p.mutex.Unlock()
+
+	p.exec(batch)
+}
+
+// take removes the queued commands. p.mutex must be held.
+func (p *autoPipeliner) take() []*pipelinedCmd {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	batch := p.queue
+	p.queue = nil
+	return batch
+}
+
+func (p *autoPipeliner) exec(batch []*pipelinedCmd) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// Commands from many callers share the pipeline, so no single caller's
+	// context applies; the client's read and write timeouts bound it.
+	ctx := context.Background()
+	pipe := p.client.Pipeline()
+	for _, queued := range batch {
+		pipe.Process(ctx, queued.cmd)
+	}
+	// Errors are reported on each command.
+	pipe.Exec(ctx)
+
+	for _, queued := range batch {
+		close(queued.done)
+	}
+}
+
+// flightGroup coalesces concurrent calls for the same key into one.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	blocked bool
+	err     error
+}
+
+func (g *flightGroup) do(key string, fn func() (bool, error)) (bool, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, exists := g.calls[key]; exists {
+		g.mutex.Unlock()
+		<-call.done
+		return call.blocked, call.err
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.blocked, call.err = fn()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	close(call.done)
+
+	return call.blocked, call.err
+}
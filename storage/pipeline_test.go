@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// commandCounter counts round trips and commands sent by a client.
+type commandCounter struct {
+	roundTrips int64
+	commands   sync.Map
+}
+
+func (c *commandCounter) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (c *commandCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		atomic.AddInt64(&c.roundTrips, 1)
+		c.count(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (c *commandCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		atomic.AddInt64(&c.roundTrips, 1)
+		for _, cmd := range cmds {
+			c.count(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func (c *commandCounter) count(cmd redis.Cmder) {
+	counter, _ := c.commands.LoadOrStore(strings.ToLower(cmd.Name()), new(int64))
+	atomic.AddInt64(counter.(*int64), 1)
+}
+
+func (c *commandCounter) commandCount(name string) int64 {
+	if counter, exists := c.commands.Load(name); exists {
+		return atomic.LoadInt64(counter.(*int64))
+	}
+	return 0
+}
+
+func newTestPipelinedStorage(t testing.TB, addr string, window time.Duration, maxBatch int) (*RedisStorage, *commandCounter) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	counter := &commandCounter{}
+	client.AddHook(counter)
+
+	r := NewRedisStorageWithClient(client, "")
+	r.pipeliner = newAutoPipeliner(client, window, maxBatch)
+	t.Cleanup(func() { r.Close() })
+	return r, counter
+}
+
+func runConcurrently(n int, fn func()) {
+	var start, done sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < n; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			fn()
+		}()
+	}
+	start.Done()
+	done.Wait()
+}
+
+func TestRedisStorage_AutoPipelining(t *testing.T) {
+	server := miniredis.RunT(t)
+	r, counter := newTestPipelinedStorage(t, server.Addr(), 20*time.Millisecond, 1000)
+	ctx := context.Background()
+
+	runConcurrently(50, func() {
+		if _, err := r.Increment(ctx, "ip:192.168.1.1"); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	if count, _ := r.GetCounter(ctx, "ip:192.168.1.1"); count != 50 {
+		t.Errorf("Expected count 50, got %d", count)
+	}
+	if trips := atomic.LoadInt64(&counter.roundTrips); trips >= 50 {
+		t.Errorf("Expected concurrent increments to share pipelines, got %d round trips", trips)
+	}
+}
+
+func TestRedisStorage_PipelineMaxBatch(t *testing.T) {
+	server := miniredis.RunT(t)
+	r, counter := newTestPipelinedStorage(t, server.Addr(), time.Hour, 10)
+	ctx := context.Background()
+
+	// Com janela de uma hora, só o tamanho máximo do lote dispara o envio
+	runConcurrently(10, func() {
+		r.Increment(ctx, "token:abc")
+	})
+
+	if count, _ := server.Get("ratelimit:v1:{token:abc}"); count != "10" {
+		t.Errorf("Expected count 10, got %s", count)
+	}
+	if trips := atomic.LoadInt64(&counter.roundTrips); trips != 1 {
+		t.Errorf("Expected one pipeline for the full batch, got %d round trips", trips)
+	}
+}
+
+func TestRedisStorage_CoalescedIsBlocked(t *testing.T) {
+	server := miniredis.RunT(t)
+	r, counter := newTestPipelinedStorage(t, server.Addr(), 20*time.Millisecond, 1000)
+	ctx := context.Background()
+	server.Set("ratelimit:v1:{ip:192.168.1.1}:blocked", "1")
+
+	var blocked int64
+	runConcurrently(50, func() {
+		isBlocked, err := r.IsBlocked(ctx, "ip:192.168.1.1")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if isBlocked {
+			atomic.AddInt64(&blocked, 1)
+		}
+	})
+
+	if blocked != 50 {
+		t.Errorf("Expected every lookup to report blocked, got %d", blocked)
+	}
+	if lookups := counter.commandCount("exists"); lookups >= 50 {
+		t.Errorf("Expected identical lookups to be coalesced, got %d EXISTS commands", lookups)
+	}
+}
+
+func TestRedisStorage_PipelineContextCancel(t *testing.T) {
+	server := miniredis.RunT(t)
+	r, _ := newTestPipelinedStorage(t, server.Addr(), time.Hour, 1000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := r.Increment(ctx, "ip:192.168.1.1"); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+// Os benchmarks usam o Redis em REDIS_BENCH_ADDR quando definido; caso
+// contrário usam o miniredis com uma latência de rede simulada, já que sem
+// round trip o pipelining não tem o que economizar.
+const benchmarkLatency = 200 * time.Microsecond
+
+type latencyConn struct {
+	net.Conn
+}
+
+func (c latencyConn) Write(p []byte) (int, error) {
+	time.Sleep(benchmarkLatency)
+	return c.Conn.Write(p)
+}
+
+func benchmarkStorage(b *testing.B, pipelined bool) *RedisStorage {
+	opts := &redis.Options{Addr: os.Getenv("REDIS_BENCH_ADDR")}
+	if opts.Addr == "" {
+		opts.Addr = miniredis.RunT(b).Addr()
+		opts.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return latencyConn{conn}, nil
+		}
+	}
+
+	client := redis.NewClient(opts)
+	r := NewRedisStorageWithClient(client, "")
+	if pipelined {
+		r.pipeliner = newAutoPipeliner(client, 100*time.Microsecond, 100)
+	}
+	b.Cleanup(func() { r.Close() })
+	return r
+}
+
+func benchmarkIncrement(b *testing.B, pipelined bool) {
+	r := benchmarkStorage(b, pipelined)
+	ctx := context.Background()
+
+	// Simula muitas requisições simultâneas por CPU, como em um servidor HTTP
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := r.Increment(ctx, "ip:192.168.1.1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchmarkIsBlocked(b *testing.B, pipelined bool) {
+	r := benchmarkStorage(b, pipelined)
+	ctx := context.Background()
+
+	// Simula muitas requisições simultâneas por CPU, como em um servidor HTTP
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := r.IsBlocked(ctx, "ip:192.168.1.1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRedisStorage_Increment(b *testing.B)          { benchmarkIncrement(b, false) }
+func BenchmarkRedisStorage_IncrementPipelined(b *testing.B) { benchmarkIncrement(b, true) }
+func BenchmarkRedisStorage_IsBlocked(b *testing.B)          { benchmarkIsBlocked(b, false) }
+func BenchmarkRedisStorage_IsBlockedPipelined(b *testing.B) { benchmarkIsBlocked(b, true) }
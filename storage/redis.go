@@ -2,55 +2,615 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
-	"strconv"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// keySuffixes are the suffixes the limiter appends to a base key. They are
+// kept outside the hash tag so every key derived from the same base key lands
+// on the same Redis Cluster slot and can be used together in scripts and
+// transactions.
+var keySuffixes = []string{":blocked", ":offenses"}
+
+const (
+	DefaultNamespace = "ratelimit"
+
+	// keySchemaVersion is part of every Redis key so a future change to the
+	// key layout can be rolled out without reading stale data.
+	keySchemaVersion = "v1"
+
+	// blockCacheMaxTTL bounds how long a block without an expiry is cached.
+	blockCacheMaxTTL = time.Minute
+)
+
+// acquireScript takes a semaphore slot: the sorted set KEYS[1] holds one
+// member per holder scored with its lease's end, so expired leases are
+// dropped before counting. ARGV is the holder, the limit, the current time
+// and the lease in milliseconds.
+var acquireScript = redis.NewScript(`
+redis.call("zremrangebyscore", KEYS[1], "-inf", ARGV[3])
+if not redis.call("zscore", KEYS[1], ARGV[1]) and redis.call("zcard", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("zadd", KEYS[1], tonumber(ARGV[3]) + tonumber(ARGV[4]), ARGV[1])
+redis.call("pexpire", KEYS[1], ARGV[4])
+return 1
+`)
+
 type RedisStorage struct {
-	client *redis.Client
+	client     redis.UniversalClient
+	prefix     string
+	blockCache *blockCache
+	pubsub     *redis.PubSub
+	pipeliner  *autoPipeliner
+}
+
+type RedisOptions struct {
+	// Addrs lists the single node, the Cluster seed nodes or, when
+	// MasterName is set, the Sentinel nodes.
+	Addrs            []string
+	Namespace        string
+	Cluster          bool
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+
+	TLS RedisTLSOptions
+
+	// BlockCacheSize enables an in-process cache of up to that many blocked
+	// keys in front of IsBlocked. With BlockCacheInvalidation, Unblock
+	// publishes the key so every instance drops it from its cache.
+	BlockCacheSize         int
+	BlockCacheInvalidation bool
+
+	// PipelineWindow enables auto-pipelining: commands issued concurrently
+	// within the window are sent in one pipeline of up to PipelineMaxBatch
+	// commands, and identical IsBlocked lookups in flight are coalesced.
+	PipelineWindow   time.Duration
+	PipelineMaxBatch int
+
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+type RedisTLSOptions struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// RedisOptionsFromEnv reads RedisOptions from the environment. Unset
+// variables keep their zero value; a variable that does not parse is an error
+// naming it.
+func RedisOptionsFromEnv() (RedisOptions, error) {
+	var env envParser
+	db := env.int("REDIS_DB")
+	cluster := env.bool("REDIS_CLUSTER")
+	tlsEnabled := env.bool("REDIS_TLS")
+	insecureSkipVerify := env.bool("REDIS_TLS_INSECURE_SKIP_VERIFY")
+	poolSize := env.int("REDIS_POOL_SIZE")
+	minIdleConns := env.int("REDIS_MIN_IDLE_CONNS")
+	dialTimeout := env.duration("REDIS_DIAL_TIMEOUT")
+	readTimeout := env.duration("REDIS_READ_TIMEOUT")
+	writeTimeout := env.duration("REDIS_WRITE_TIMEOUT")
+	blockCacheSize := env.int("REDIS_BLOCK_CACHE_SIZE")
+	blockCacheInvalidation := env.bool("REDIS_BLOCK_CACHE_INVALIDATION")
+	pipelineWindow := env.duration("REDIS_PIPELINE_WINDOW")
+	pipelineMaxBatch := env.int("REDIS_PIPELINE_MAX_BATCH")
+	if env.err != nil {
+		return RedisOptions{}, env.err
+	}
+
+	addrs := splitAddrs(os.Getenv("REDIS_ADDRS"))
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT"))}
+	}
+
+	return RedisOptions{
+		Addrs:            addrs,
+		Namespace:        os.Getenv("REDIS_NAMESPACE"),
+		Cluster:          cluster,
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		Username:         os.Getenv("REDIS_USERNAME"),
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		DB:               db,
+		TLS: RedisTLSOptions{
+			Enabled:            tlsEnabled,
+			CAFile:             os.Getenv("REDIS_TLS_CA_FILE"),
+			CertFile:           os.Getenv("REDIS_TLS_CERT_FILE"),
+			KeyFile:            os.Getenv("REDIS_TLS_KEY_FILE"),
+			ServerName:         os.Getenv("REDIS_TLS_SERVER_NAME"),
+			InsecureSkipVerify: insecureSkipVerify,
+		},
+		BlockCacheSize:         blockCacheSize,
+		BlockCacheInvalidation: blockCacheInvalidation,
+		PipelineWindow:         pipelineWindow,
+		PipelineMaxBatch:       pipelineMaxBatch,
+		PoolSize:               poolSize,
+		MinIdleConns:           minIdleConns,
+		DialTimeout:            dialTimeout,
+		ReadTimeout:            readTimeout,
+		WriteTimeout:           writeTimeout,
+	}, nil
 }
 
 func NewRedisStorage() (*RedisStorage, error) {
-	host := os.Getenv("REDIS_HOST")
-	port := os.Getenv("REDIS_PORT")
-	password := os.Getenv("REDIS_PASSWORD")
-	db, _ := strconv.Atoi(os.Getenv("REDIS_DB"))
-
-	client := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", host, port),
-		Password: password,
-		DB:       db,
-	})
+	opts, err := RedisOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisStorageWithOptions(opts)
+}
+
+func NewRedisStorageWithOptions(opts RedisOptions) (*RedisStorage, error) {
+	universalOptions, err := opts.universalOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	client := newUniversalClient(universalOptions, opts.Cluster)
 
 	ctx := context.Background()
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
 	}
 
-	return &RedisStorage{client: client}, nil
+	r := NewRedisStorageWithClient(client, opts.Namespace)
+	if opts.PipelineWindow > 0 {
+		r.pipeliner = newAutoPipeliner(client, opts.PipelineWindow, opts.PipelineMaxBatch)
+	}
+	if opts.BlockCacheSize > 0 {
+		r.blockCache = newBlockCache(opts.BlockCacheSize)
+		if opts.BlockCacheInvalidation {
+			if err := r.subscribeUnblocks(ctx); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("failed to subscribe to unblock events: %v", err)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// NewRedisStorageWithClient wraps an existing single-node, Sentinel or
+// Cluster client. Keys are stored under namespace, or DefaultNamespace when
+// it is empty.
+func NewRedisStorageWithClient(client redis.UniversalClient, namespace string) *RedisStorage {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &RedisStorage{
+		client: client,
+		prefix: namespace + ":" + keySchemaVersion + ":",
+	}
 }
 
 func (r *RedisStorage) Increment(ctx context.Context, key string) (int64, error) {
-	return r.client.Incr(ctx, key).Result()
+	cmd := redis.NewIntCmd(ctx, "incr", r.key(key))
+	if err := r.process(ctx, cmd); err != nil {
+		return 0, err
+	}
+	return cmd.Val(), nil
+}
+
+func (r *RedisStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	cmd := redis.NewIntCmd(ctx, "incrby", r.key(key), n)
+	if err := r.process(ctx, cmd); err != nil {
+		return 0, err
+	}
+	return cmd.Val(), nil
 }
 
 func (r *RedisStorage) SetExpiration(ctx context.Context, key string, duration int) error {
-	return r.client.Expire(ctx, key, time.Duration(duration)*time.Second).Err()
+	cmd := redis.NewBoolCmd(ctx, "expire", r.key(key), duration)
+	return r.process(ctx, cmd)
 }
 
 func (r *RedisStorage) GetCounter(ctx context.Context, key string) (int64, error) {
-	return r.client.Get(ctx, key).Int64()
+	cmd := redis.NewStringCmd(ctx, "get", r.key(key))
+	if err := r.process(ctx, cmd); err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return cmd.Int64()
+}
+
+// TTL returns the time left before key expires, or zero when the key does
+// not exist or has no expiry. The blocks of keys in the block cache are
+// answered from it, without Redis.
+func (r *RedisStorage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if base, found := strings.CutSuffix(key, ":blocked"); found && r.blockCache != nil {
+		if ttl, cached := r.blockCache.ttl(base); cached {
+			return ttl, nil
+		}
+	}
+	cmd := redis.NewDurationCmd(ctx, time.Millisecond, "pttl", r.key(key))
+	if err := r.process(ctx, cmd); err != nil {
+		return 0, err
+	}
+	if ttl := cmd.Val(); ttl > 0 {
+		return ttl, nil
+	}
+	return 0, nil
 }
 
 func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	blockedKey := fmt.Sprintf("%s:blocked", key)
-	exists, err := r.client.Exists(ctx, blockedKey).Result()
+	if r.blockCache != nil && r.blockCache.blocked(key) {
+		return true, nil
+	}
+	if r.pipeliner == nil {
+		return r.lookupBlocked(ctx, key)
+	}
+	// Followers share the leader's lookup, so it must outlive the leader's
+	// context.
+	return r.pipeliner.lookups.do(key, func() (bool, error) {
+		return r.lookupBlocked(context.WithoutCancel(ctx), key)
+	})
+}
+
+func (r *RedisStorage) lookupBlocked(ctx context.Context, key string) (bool, error) {
+	blockedKey := r.key(fmt.Sprintf("%s:blocked", key))
+
+	if r.blockCache == nil {
+		cmd := redis.NewIntCmd(ctx, "exists", blockedKey)
+		if err := r.process(ctx, cmd); err != nil {
+			return false, err
+		}
+		return cmd.Val() == 1, nil
+	}
+
+	// PTTL returns -2 for a missing key and -1 for a key without expiry.
+	cmd := redis.NewDurationCmd(ctx, time.Millisecond, "pttl", blockedKey)
+	if err := r.process(ctx, cmd); err != nil {
+		return false, err
+	}
+	ttl := cmd.Val()
+	switch {
+	case ttl == -2:
+		return false, nil
+	case ttl < 0:
+		r.blockCache.addPermanent(key)
+	default:
+		r.blockCache.add(key, ttl)
+	}
+	return true, nil
+}
+
+func (r *RedisStorage) Block(ctx context.Context, key string, duration int) error {
+	if duration <= 0 {
+		return nil
+	}
+	cmd := redis.NewStatusCmd(ctx, "set", r.key(fmt.Sprintf("%s:blocked", key)), 1, "ex", duration)
+	if err := r.process(ctx, cmd); err != nil {
+		return err
+	}
+	if r.blockCache != nil {
+		r.blockCache.add(key, time.Duration(duration)*time.Second)
+	}
+	return nil
+}
+
+// Unblock lifts a block before it expires. The key is always published, even
+// by instances that do not cache blocks themselves, so that instances with
+// block cache invalidation enabled forget it; delivery is best effort, so an
+// instance that misses the message keeps the key until the cached block
+// expires.
+func (r *RedisStorage) Unblock(ctx context.Context, key string) error {
+	if err := r.client.Del(ctx, r.key(fmt.Sprintf("%s:blocked", key))).Err(); err != nil {
+		return err
+	}
+	if r.blockCache != nil {
+		r.blockCache.remove(key)
+	}
+	return r.client.Publish(ctx, r.unblockChannel(), key).Err()
+}
+
+// AddListEntry adds entry to the Redis set of list, e.g.
+// "ratelimit:v1:{list:denylist}".
+func (r *RedisStorage) AddListEntry(ctx context.Context, list string, entry string) error {
+	return r.client.SAdd(ctx, r.listKey(list), entry).Err()
+}
+
+func (r *RedisStorage) RemoveListEntry(ctx context.Context, list string, entry string) error {
+	return r.client.SRem(ctx, r.listKey(list), entry).Err()
+}
+
+func (r *RedisStorage) ListEntries(ctx context.Context, list string) ([]string, error) {
+	return r.client.SMembers(ctx, r.listKey(list)).Result()
+}
+
+// Acquire takes a slot of the semaphore key, a sorted set of holders. Lease
+// ends are computed with this instance's clock, so instances must keep their
+// clocks in sync.
+func (r *RedisStorage) Acquire(ctx context.Context, key string, holder string, limit int, lease time.Duration) (bool, error) {
+	now := time.Now().UnixMilli()
+	acquired, err := acquireScript.Run(ctx, r.client, []string{r.key(key)}, holder, limit, now, lease.Milliseconds()).Int()
 	if err != nil {
 		return false, err
 	}
-	return exists == 1, nil
+	return acquired == 1, nil
+}
+
+func (r *RedisStorage) Release(ctx context.Context, key string, holder string) error {
+	return r.client.ZRem(ctx, r.key(key), holder).Err()
+}
+
+func (r *RedisStorage) Close() error {
+	if r.pipeliner != nil {
+		r.pipeliner.flush()
+	}
+	if r.pubsub != nil {
+		r.pubsub.Close()
+	}
+	return r.client.Close()
+}
+
+// process runs a single command, through the auto-pipeliner when enabled.
+func (r *RedisStorage) process(ctx context.Context, cmd redis.Cmder) error {
+	if r.pipeliner != nil {
+		return r.pipeliner.process(ctx, cmd)
+	}
+	return r.client.Process(ctx, cmd)
+}
+
+func (r *RedisStorage) subscribeUnblocks(ctx context.Context) error {
+	pubsub := r.client.Subscribe(ctx, r.unblockChannel())
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+	r.pubsub = pubsub
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			r.blockCache.remove(msg.Payload)
+		}
+	}()
+	return nil
+}
+
+func (r *RedisStorage) unblockChannel() string {
+	return r.prefix + "unblock"
+}
+
+// newUniversalClient builds a Sentinel client when a master name is set and a
+// Cluster client when several addresses are given or cluster mode is forced,
+// falling back to a single-node client.
+func newUniversalClient(opts *redis.UniversalOptions, cluster bool) redis.UniversalClient {
+	if cluster && opts.MasterName == "" {
+		return redis.NewClusterClient(opts.Cluster())
+	}
+	return redis.NewUniversalClient(opts)
+}
+
+func (o RedisOptions) universalOptions() (*redis.UniversalOptions, error) {
+	tlsConfig, err := o.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return &redis.UniversalOptions{
+		Addrs:            o.Addrs,
+		MasterName:       o.MasterName,
+		Username:         o.Username,
+		Password:         o.Password,
+		SentinelPassword: o.SentinelPassword,
+		DB:               o.DB,
+		TLSConfig:        tlsConfig,
+		PoolSize:         o.PoolSize,
+		MinIdleConns:     o.MinIdleConns,
+		DialTimeout:      o.DialTimeout,
+		ReadTimeout:      o.ReadTimeout,
+		WriteTimeout:     o.WriteTimeout,
+	}, nil
+}
+
+func (o RedisTLSOptions) config() (*tls.Config, error) {
+	if !o.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		caCert, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func splitAddrs(value string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// ScanKeys calls fn with every limiter key under the namespace whose logical
+// key (e.g. "ip:1.2.3.4" or "ip:1.2.3.4:blocked") matches the Redis glob
+// pattern. An empty pattern matches every key. On a Cluster all masters are
+// scanned.
+func (r *RedisStorage) ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	// Logical keys are stored with their base in a hash tag, so a logical
+	// pattern cannot be handed to SCAN as is: an exact key is looked up in
+	// its stored form, and other patterns are matched against the logical
+	// keys of the whole namespace.
+	match := escapeGlob(r.prefix) + "{*"
+	matches := globMatcher(pattern)
+	if !strings.ContainsAny(pattern, `*?[\`) {
+		match = escapeGlob(r.key(pattern))
+	}
+	visit := func(key string) error {
+		if !matches(key) {
+			return nil
+		}
+		return fn(key)
+	}
+
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		var mutex sync.Mutex
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return r.scan(ctx, node, match, func(key string) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return visit(key)
+			})
+		})
+	}
+	return r.scan(ctx, r.client, match, visit)
+}
+
+func (r *RedisStorage) scan(ctx context.Context, client redis.Cmdable, match string, fn func(key string) error) error {
+	iter := client.Scan(ctx, 0, match, 100).Iterator()
+	for iter.Next(ctx) {
+		if key, ok := r.logicalKey(iter.Val()); ok {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+	}
+	return iter.Err()
+}
+
+// escapeGlob escapes the Redis glob metacharacters of s, e.g. in a namespace.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// globMatcher reports whether a key matches a Redis glob pattern: * matches
+// any characters, ? one character, [...] one of a class, [^...] one outside
+// it, and \ escapes the next character.
+func globMatcher(pattern string) func(key string) bool {
+	runes := []rune(pattern)
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case '[':
+			end := i + 1
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end >= len(runes) || end == i+1 {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := string(runes[i+1 : end])
+			negate := strings.HasPrefix(class, "^")
+			class = strings.NewReplacer(`\`, `\\`, `[`, `\[`).Replace(strings.TrimPrefix(class, "^"))
+			if negate {
+				class = "^" + class
+			}
+			b.WriteString("[" + class + "]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		// Patterns Go cannot compile, like a reversed range, match literally.
+		return func(key string) bool { return key == pattern }
+	}
+	return re.MatchString
+}
+
+// key maps a logical key to its Redis key: the namespace and schema version
+// prefix followed by the base key in a hash tag, e.g. "ip:1.2.3.4:blocked"
+// becomes "ratelimit:v1:{ip:1.2.3.4}:blocked".
+func (r *RedisStorage) key(key string) string {
+	for _, suffix := range keySuffixes {
+		if base, found := strings.CutSuffix(key, suffix); found {
+			return r.prefix + "{" + base + "}" + suffix
+		}
+	}
+	return r.prefix + "{" + key + "}"
+}
+
+func (r *RedisStorage) listKey(list string) string {
+	return r.key("list:" + list)
+}
+
+// logicalKey maps a Redis key back to its logical key, undoing key. The hash
+// tag is closed by the "}" before a known suffix or at the end, since the
+// base key may contain "}" itself.
+func (r *RedisStorage) logicalKey(redisKey string) (string, bool) {
+	key, found := strings.CutPrefix(redisKey, r.prefix+"{")
+	if !found {
+		return "", false
+	}
+	for _, suffix := range keySuffixes {
+		if base, found := strings.CutSuffix(key, "}"+suffix); found {
+			return base + suffix, true
+		}
+	}
+	if base, found := strings.CutSuffix(key, "}"); found {
+		return base, true
+	}
+	return "", false
 }
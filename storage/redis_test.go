@@ -1,8 +1,24 @@
 package storage
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 )
 
 func TestNewRedisStorage_WithoutRedis(t *testing.T) {
@@ -30,13 +46,554 @@ func TestNewRedisStorage_InvalidPort(t *testing.T) {
 }
 
 func TestNewRedisStorage_InvalidDB(t *testing.T) {
-	os.Setenv("REDIS_HOST", "localhost")
-	os.Setenv("REDIS_PORT", "6379")
-	os.Setenv("REDIS_PASSWORD", "")
-	os.Setenv("REDIS_DB", "invalid")
+	t.Setenv("REDIS_HOST", "localhost")
+	t.Setenv("REDIS_PORT", "6379")
+	t.Setenv("REDIS_PASSWORD", "")
+	t.Setenv("REDIS_DB", "invalid")
 
 	_, err := NewRedisStorage()
+	if err == nil || !strings.Contains(err.Error(), "REDIS_DB") {
+		t.Errorf("Expected error naming REDIS_DB, got %v", err)
+	}
+}
+
+func TestNewUniversalClient_Modes(t *testing.T) {
+	single := newUniversalClient(&redis.UniversalOptions{Addrs: []string{"localhost:6379"}}, false)
+	defer single.Close()
+	if _, ok := single.(*redis.Client); !ok {
+		t.Errorf("Expected single-node client, got %T", single)
+	}
+
+	cluster := newUniversalClient(&redis.UniversalOptions{Addrs: []string{"node1:6379", "node2:6379"}}, false)
+	defer cluster.Close()
+	if _, ok := cluster.(*redis.ClusterClient); !ok {
+		t.Errorf("Expected cluster client, got %T", cluster)
+	}
+
+	forced := newUniversalClient(&redis.UniversalOptions{Addrs: []string{"node1:6379"}}, true)
+	defer forced.Close()
+	if _, ok := forced.(*redis.ClusterClient); !ok {
+		t.Errorf("Expected forced cluster client, got %T", forced)
+	}
+
+	sentinel := newUniversalClient(&redis.UniversalOptions{
+		Addrs:      []string{"sentinel1:26379", "sentinel2:26379"},
+		MasterName: "mymaster",
+	}, true)
+	defer sentinel.Close()
+	if _, ok := sentinel.(*redis.Client); !ok {
+		t.Errorf("Expected failover client, got %T", sentinel)
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	addrs := splitAddrs(" node1:6379, node2:6379,,node3:6379 ")
+	expected := []string{"node1:6379", "node2:6379", "node3:6379"}
+
+	if len(addrs) != len(expected) {
+		t.Fatalf("Expected %d addresses, got %d", len(expected), len(addrs))
+	}
+	for i := range expected {
+		if addrs[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], addrs[i])
+		}
+	}
+
+	if len(splitAddrs("")) != 0 {
+		t.Error("Expected no addresses for empty value")
+	}
+}
+
+func TestRedisKey_HashTags(t *testing.T) {
+	r := NewRedisStorageWithClient(nil, "")
+
+	if key := r.key("ip:192.168.1.1"); key != "ratelimit:v1:{ip:192.168.1.1}" {
+		t.Errorf("Unexpected counter key %s", key)
+	}
+	if key := r.key("ip:192.168.1.1:blocked"); key != "ratelimit:v1:{ip:192.168.1.1}:blocked" {
+		t.Errorf("Unexpected blocked key %s", key)
+	}
+	if key := r.key("ip:192.168.1.1:offenses"); key != "ratelimit:v1:{ip:192.168.1.1}:offenses" {
+		t.Errorf("Unexpected offenses key %s", key)
+	}
+
+	counterTag := hashTag(r.key("token:abc"))
+	blockedTag := hashTag(r.key("token:abc:blocked"))
+	if counterTag != blockedTag {
+		t.Errorf("Counter and blocked keys should share a hash tag, got %s and %s", counterTag, blockedTag)
+	}
+}
+
+func hashTag(key string) string {
+	start := strings.Index(key, "{")
+	end := strings.Index(key, "}")
+	return key[start+1 : end]
+}
+
+func TestRedisOptionsFromEnv(t *testing.T) {
+	t.Setenv("REDIS_ADDRS", "node1:6379,node2:6379")
+	t.Setenv("REDIS_USERNAME", "limiter")
+	t.Setenv("REDIS_PASSWORD", "secret")
+	t.Setenv("REDIS_TLS", "true")
+	t.Setenv("REDIS_TLS_SERVER_NAME", "redis.internal")
+	t.Setenv("REDIS_POOL_SIZE", "50")
+	t.Setenv("REDIS_MIN_IDLE_CONNS", "5")
+	t.Setenv("REDIS_DIAL_TIMEOUT", "2s")
+	t.Setenv("REDIS_READ_TIMEOUT", "500ms")
+	t.Setenv("REDIS_WRITE_TIMEOUT", "750ms")
+
+	opts, err := RedisOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(opts.Addrs) != 2 {
+		t.Errorf("Expected 2 addresses, got %d", len(opts.Addrs))
+	}
+	if opts.Username != "limiter" || opts.Password != "secret" {
+		t.Errorf("Unexpected credentials %s/%s", opts.Username, opts.Password)
+	}
+	if !opts.TLS.Enabled || opts.TLS.ServerName != "redis.internal" {
+		t.Errorf("Unexpected TLS options %+v", opts.TLS)
+	}
+	if opts.PoolSize != 50 || opts.MinIdleConns != 5 {
+		t.Errorf("Unexpected pool options %d/%d", opts.PoolSize, opts.MinIdleConns)
+	}
+	if opts.DialTimeout != 2*time.Second || opts.ReadTimeout != 500*time.Millisecond || opts.WriteTimeout != 750*time.Millisecond {
+		t.Errorf("Unexpected timeouts %v/%v/%v", opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout)
+	}
+}
+
+func TestRedisOptions_UniversalOptions(t *testing.T) {
+	opts := RedisOptions{
+		Addrs:        []string{"localhost:6379"},
+		Username:     "limiter",
+		Password:     "secret",
+		DB:           2,
+		PoolSize:     20,
+		MinIdleConns: 4,
+		DialTimeout:  time.Second,
+	}
+
+	universal, err := opts.universalOptions()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if universal.Username != "limiter" || universal.Password != "secret" || universal.DB != 2 {
+		t.Errorf("Unexpected connection options %+v", universal)
+	}
+	if universal.PoolSize != 20 || universal.MinIdleConns != 4 || universal.DialTimeout != time.Second {
+		t.Errorf("Unexpected pool options %+v", universal)
+	}
+	if universal.TLSConfig != nil {
+		t.Error("TLS should be disabled by default")
+	}
+}
+
+func TestRedisTLSOptions_Config(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	config, err := RedisTLSOptions{
+		Enabled:    true,
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "redis.internal",
+	}.config()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RootCAs == nil {
+		t.Error("Expected custom CA pool")
+	}
+	if len(config.Certificates) != 1 {
+		t.Errorf("Expected client certificate, got %d", len(config.Certificates))
+	}
+	if config.ServerName != "redis.internal" {
+		t.Errorf("Expected server name redis.internal, got %s", config.ServerName)
+	}
+}
+
+func TestRedisTLSOptions_InvalidFiles(t *testing.T) {
+	_, err := RedisTLSOptions{Enabled: true, CAFile: "missing-ca.pem"}.config()
+	if err == nil {
+		t.Error("Expected error with missing CA file")
+	}
+
+	invalidCA := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(invalidCA, []byte("not a certificate"), 0600)
+	_, err = RedisTLSOptions{Enabled: true, CAFile: invalidCA}.config()
 	if err == nil {
-		t.Error("Expected error with invalid DB")
+		t.Error("Expected error with invalid CA file")
+	}
+
+	_, err = NewRedisStorageWithOptions(RedisOptions{
+		Addrs: []string{"localhost:6379"},
+		TLS:   RedisTLSOptions{Enabled: true, CertFile: "missing-cert.pem", KeyFile: "missing-key.pem"},
+	})
+	if err == nil {
+		t.Error("Expected error with missing client certificate")
+	}
+}
+
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.internal"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+func newTestRedisStorage(t *testing.T, namespace string) (*RedisStorage, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisStorageWithClient(client, namespace), server
+}
+
+func TestRedisStorage_Namespace(t *testing.T) {
+	appA, server := newTestRedisStorage(t, "app-a")
+	appB := NewRedisStorageWithClient(appA.client, "app-b")
+	ctx := context.Background()
+
+	appA.Increment(ctx, "ip:192.168.1.1")
+	appA.Increment(ctx, "ip:192.168.1.1")
+	appB.Increment(ctx, "ip:192.168.1.1")
+
+	if count, _ := appA.GetCounter(ctx, "ip:192.168.1.1"); count != 2 {
+		t.Errorf("Expected count 2 in app-a, got %d", count)
+	}
+	if count, _ := appB.GetCounter(ctx, "ip:192.168.1.1"); count != 1 {
+		t.Errorf("Expected count 1 in app-b, got %d", count)
+	}
+	if !server.Exists("app-a:v1:{ip:192.168.1.1}") {
+		t.Error("Expected namespaced and versioned key in Redis")
+	}
+}
+
+func TestRedisStorage_ScanKeys(t *testing.T) {
+	r, server := newTestRedisStorage(t, "")
+	ctx := context.Background()
+
+	r.Increment(ctx, "ip:192.168.1.1")
+	r.Increment(ctx, "ip:192.168.1.2")
+	r.Increment(ctx, "token:abc")
+	r.Increment(ctx, "token:a}b")
+	r.Block(ctx, "token:a}b", 60)
+	server.Set("ratelimit:v1:{ip:192.168.1.1}:blocked", "1")
+	server.Set("other-app:ip:192.168.1.1", "1")
+
+	var all []string
+	err := r.ScanKeys(ctx, "", func(key string) error {
+		all = append(all, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sort.Strings(all)
+	expected := []string{"ip:192.168.1.1", "ip:192.168.1.1:blocked", "ip:192.168.1.2", "token:abc", "token:a}b", "token:a}b:blocked"}
+	if strings.Join(all, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected keys %v, got %v", expected, all)
+	}
+
+	var ipKeys []string
+	r.ScanKeys(ctx, "ip:*", func(key string) error {
+		ipKeys = append(ipKeys, key)
+		return nil
+	})
+	if len(ipKeys) != 3 {
+		t.Errorf("Expected 3 ip keys, got %v", ipKeys)
+	}
+
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"ip:192.168.1.1", []string{"ip:192.168.1.1"}},
+		{"ip:192.168.1.1:blocked", []string{"ip:192.168.1.1:blocked"}},
+		{"ip:192.168.1.?", []string{"ip:192.168.1.1", "ip:192.168.1.2"}},
+		{"ip:*:blocked", []string{"ip:192.168.1.1:blocked"}},
+		{"ip:192.168.1.[^1]", []string{"ip:192.168.1.2"}},
+		{"token:abc:blocked", nil},
+		{"token:a}*", []string{"token:a}b", "token:a}b:blocked"}},
+	}
+	for _, tt := range tests {
+		var keys []string
+		r.ScanKeys(ctx, tt.pattern, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("ScanKeys(%q): expected %v, got %v", tt.pattern, tt.expected, keys)
+		}
+	}
+
+	stop := errors.New("stop")
+	err = r.ScanKeys(ctx, "", func(key string) error { return stop })
+	if err != stop {
+		t.Errorf("Expected callback error to be returned, got %v", err)
+	}
+}
+
+func TestRedisStorage_ScanKeys_GlobNamespace(t *testing.T) {
+	r, server := newTestRedisStorage(t, "app[1]")
+	ctx := context.Background()
+
+	r.Increment(ctx, "ip:192.168.1.1")
+	server.Set("app1:v1:{ip:192.168.1.2}", "1")
+
+	var keys []string
+	r.ScanKeys(ctx, "ip:*", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "ip:192.168.1.1" {
+		t.Errorf("Expected only the keys of the namespace, got %v", keys)
+	}
+}
+
+func TestRedisStorage_Block(t *testing.T) {
+	r, server := newTestRedisStorage(t, "")
+	ctx := context.Background()
+
+	blocked, err := r.IsBlocked(ctx, "ip:192.168.1.1")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if blocked {
+		t.Error("Expected not blocked")
+	}
+
+	if err := r.Block(ctx, "ip:192.168.1.1", 300); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if ttl := server.TTL("ratelimit:v1:{ip:192.168.1.1}:blocked"); ttl != 300*time.Second {
+		t.Errorf("Expected block TTL 300s, got %v", ttl)
+	}
+
+	blocked, _ = r.IsBlocked(ctx, "ip:192.168.1.1")
+	if !blocked {
+		t.Error("Expected blocked")
+	}
+
+	server.FastForward(300 * time.Second)
+	blocked, _ = r.IsBlocked(ctx, "ip:192.168.1.1")
+	if blocked {
+		t.Error("Expected block to expire")
+	}
+}
+
+func TestRedisStorage_BlockCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	r, err := NewRedisStorageWithOptions(RedisOptions{
+		Addrs:          []string{server.Addr()},
+		BlockCacheSize: 100,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	server.Set("ratelimit:v1:{ip:192.168.1.1}:blocked", "1")
+	server.SetTTL("ratelimit:v1:{ip:192.168.1.1}:blocked", time.Minute)
+
+	blocked, _ := r.IsBlocked(ctx, "ip:192.168.1.1")
+	if !blocked {
+		t.Fatal("Expected blocked")
+	}
+
+	// O cache deve responder sem consultar o Redis
+	server.Close()
+	blocked, err = r.IsBlocked(ctx, "ip:192.168.1.1")
+	if err != nil {
+		t.Errorf("Expected cached answer without Redis, got error: %v", err)
+	}
+	if !blocked {
+		t.Error("Expected cached block")
+	}
+}
+
+func TestRedisStorage_UnblockInvalidation(t *testing.T) {
+	server := miniredis.RunT(t)
+	opts := RedisOptions{
+		Addrs:                  []string{server.Addr()},
+		BlockCacheSize:         100,
+		BlockCacheInvalidation: true,
+	}
+	admin, err := NewRedisStorageWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer admin.Close()
+	instance, err := NewRedisStorageWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer instance.Close()
+	ctx := context.Background()
+
+	admin.Block(ctx, "token:abc", 300)
+	if blocked, _ := instance.IsBlocked(ctx, "token:abc"); !blocked {
+		t.Fatal("Expected blocked")
+	}
+
+	if err := admin.Unblock(ctx, "token:abc"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for instance.blockCache.blocked("token:abc") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected unblock to invalidate the other instance's cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if blocked, _ := instance.IsBlocked(ctx, "token:abc"); blocked {
+		t.Error("Expected key to be unblocked")
+	}
+}
+
+func TestRedisStorage_UnblockWithoutSubscription(t *testing.T) {
+	server := miniredis.RunT(t)
+	admin, err := NewRedisStorageWithOptions(RedisOptions{Addrs: []string{server.Addr()}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer admin.Close()
+	instance, err := NewRedisStorageWithOptions(RedisOptions{
+		Addrs:                  []string{server.Addr()},
+		BlockCacheSize:         100,
+		BlockCacheInvalidation: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer instance.Close()
+	ctx := context.Background()
+
+	admin.Block(ctx, "token:abc", 300)
+	if blocked, _ := instance.IsBlocked(ctx, "token:abc"); !blocked {
+		t.Fatal("Expected blocked")
+	}
+
+	if admin.pubsub != nil {
+		t.Fatal("Expected the admin instance not to subscribe")
+	}
+	if err := admin.Unblock(ctx, "token:abc"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for instance.blockCache.blocked("token:abc") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected an unsubscribed instance's unblock to invalidate the other instance's cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisStorage_Counters(t *testing.T) {
+	r, _ := newTestRedisStorage(t, "")
+	ctx := context.Background()
+
+	count, err := r.GetCounter(ctx, "ip:192.168.1.1")
+	if err != nil {
+		t.Errorf("Expected no error for missing counter, got %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected count 0, got %d", count)
+	}
+
+	count, _ = r.IncrementBy(ctx, "ip:192.168.1.1", 5)
+	if count != 5 {
+		t.Errorf("Expected count 5, got %d", count)
+	}
+
+	if ttl, _ := r.TTL(ctx, "ip:192.168.1.1"); ttl != 0 {
+		t.Errorf("Expected no TTL, got %v", ttl)
+	}
+	r.SetExpiration(ctx, "ip:192.168.1.1", 60)
+	if ttl, _ := r.TTL(ctx, "ip:192.168.1.1"); ttl != time.Minute {
+		t.Errorf("Expected TTL 60s, got %v", ttl)
+	}
+}
+
+func TestRedisStorage_Lists(t *testing.T) {
+	r, server := newTestRedisStorage(t, "")
+	ctx := context.Background()
+
+	r.AddListEntry(ctx, "allowlist", "10.0.0.0/8")
+	r.AddListEntry(ctx, "allowlist", "key:health")
+	r.RemoveListEntry(ctx, "allowlist", "key:health")
+
+	entries, err := r.ListEntries(ctx, "allowlist")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0] != "10.0.0.0/8" {
+		t.Errorf("Expected [10.0.0.0/8], got %v", entries)
+	}
+	if !server.Exists("ratelimit:v1:{list:allowlist}") {
+		t.Error("Expected the list under ratelimit:v1:{list:allowlist}")
+	}
+}
+
+func TestRedisStorage_Semaphore(t *testing.T) {
+	r, server := newTestRedisStorage(t, "")
+	ctx := context.Background()
+
+	for _, holder := range []string{"a", "b"} {
+		if acquired, err := r.Acquire(ctx, "inflight:ip:1.2.3.4", holder, 2, time.Minute); err != nil || !acquired {
+			t.Errorf("Expected %s to acquire a slot, got %v, %v", holder, acquired, err)
+		}
+	}
+	if acquired, _ := r.Acquire(ctx, "inflight:ip:1.2.3.4", "c", 2, time.Minute); acquired {
+		t.Error("Expected no slot left")
+	}
+	if acquired, _ := r.Acquire(ctx, "inflight:ip:1.2.3.4", "a", 2, time.Minute); !acquired {
+		t.Error("Expected the holder to renew its slot")
+	}
+	if ttl := server.TTL("ratelimit:v1:{inflight:ip:1.2.3.4}"); ttl != time.Minute {
+		t.Errorf("Expected the semaphore to expire with its leases, got %v", ttl)
+	}
+
+	r.Release(ctx, "inflight:ip:1.2.3.4", "a")
+	if acquired, _ := r.Acquire(ctx, "inflight:ip:1.2.3.4", "c", 2, time.Minute); !acquired {
+		t.Error("Expected the released slot to be free")
+	}
+
+	// Leases are scored with their end, so expired ones free their slot.
+	r.Acquire(ctx, "inflight:ip:5.6.7.8", "a", 1, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if acquired, _ := r.Acquire(ctx, "inflight:ip:5.6.7.8", "b", 1, time.Minute); !acquired {
+		t.Error("Expected the expired lease to free its slot")
 	}
 }
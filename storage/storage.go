@@ -1,13 +1,96 @@
 package storage
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
 
 type Storage interface {
 	Increment(ctx context.Context, key string) (int64, error)
 
+	IncrementBy(ctx context.Context, key string, n int64) (int64, error)
+
 	SetExpiration(ctx context.Context, key string, duration int) error
 
 	GetCounter(ctx context.Context, key string) (int64, error)
 
 	IsBlocked(ctx context.Context, key string) (bool, error)
+
+	// Block blocks key for duration seconds. A duration of zero or less
+	// writes no block, as a block that ends right away.
+	Block(ctx context.Context, key string, duration int) error
+}
+
+// TTLStorage is implemented by storages that can tell how long a key has
+// left. The block of a key lives in "<key>:blocked".
+type TTLStorage interface {
+	// TTL returns the time left before key expires, or zero when the key
+	// does not exist or has no expiry.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+}
+
+// ListStorage is implemented by storages that can hold sets of strings shared
+// by every instance, such as the limiter's allow and deny lists.
+type ListStorage interface {
+	AddListEntry(ctx context.Context, list string, entry string) error
+
+	RemoveListEntry(ctx context.Context, list string, entry string) error
+
+	ListEntries(ctx context.Context, list string) ([]string, error)
+}
+
+// SemaphoreStorage is implemented by storages that hold semaphores shared by
+// every instance. Slots are leased to a holder and free themselves once the
+// lease expires, so a crashed instance does not hold them forever.
+type SemaphoreStorage interface {
+	// Acquire takes one of limit slots of key for holder until lease ends,
+	// reporting false when every slot is taken. Acquiring a slot the holder
+	// already has renews its lease.
+	Acquire(ctx context.Context, key string, holder string, limit int, lease time.Duration) (bool, error)
+
+	Release(ctx context.Context, key string, holder string) error
+}
+
+// envParser reads environment variables for the *OptionsFromEnv functions,
+// keeping the first error so the variables can be read in a row and checked
+// once.
+type envParser struct {
+	err error
+}
+
+func (p *envParser) int(key string) int {
+	return parseEnv(p, key, strconv.Atoi)
+}
+
+func (p *envParser) int64(key string) int64 {
+	return parseEnv(p, key, func(value string) (int64, error) {
+		return strconv.ParseInt(value, 10, 64)
+	})
+}
+
+func (p *envParser) bool(key string) bool {
+	return parseEnv(p, key, strconv.ParseBool)
+}
+
+func (p *envParser) duration(key string) time.Duration {
+	return parseEnv(p, key, time.ParseDuration)
+}
+
+// parseEnv parses the variable key with parse, returning the zero value when
+// it is unset or does not parse.
+func parseEnv[T any](p *envParser, key string, parse func(string) (T, error)) T {
+	var zero T
+	value := os.Getenv(key)
+	if value == "" || p.err != nil {
+		return zero
+	}
+	parsed, err := parse(value)
+	if err != nil {
+		p.err = fmt.Errorf("invalid %s: %v", key, err)
+		return zero
+	}
+	return parsed
 }
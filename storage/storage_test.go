@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestBlock_NonPositiveDuration(t *testing.T) {
+	memory := NewMemoryStorage(MemoryOptions{})
+	defer memory.Close()
+	redisStorage, err := NewRedisStorageWithOptions(RedisOptions{
+		Addrs:          []string{miniredis.RunT(t).Addr()},
+		BlockCacheSize: 100,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer redisStorage.Close()
+	hybrid := NewHybridStorage(NewMemoryStorage(MemoryOptions{}), HybridOptions{FlushInterval: time.Hour})
+	defer hybrid.Close()
+
+	backends := map[string]Storage{
+		"memory": memory,
+		"redis":  redisStorage,
+		"hybrid": hybrid,
+		"mock":   NewMockStorage(),
+	}
+	ctx := context.Background()
+
+	for name, backend := range backends {
+		for _, duration := range []int{0, -1} {
+			if err := backend.Block(ctx, "ip:192.168.1.1", duration); err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			if blocked, _ := backend.IsBlocked(ctx, "ip:192.168.1.1"); blocked {
+				t.Errorf("%s: expected a duration of %d to block nothing", name, duration)
+			}
+		}
+
+		backend.Block(ctx, "ip:192.168.1.1", 60)
+		if blocked, _ := backend.IsBlocked(ctx, "ip:192.168.1.1"); !blocked {
+			t.Errorf("%s: expected a positive duration to block", name)
+		}
+	}
+}
+
+func TestOptionsFromEnv_Invalid(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		read  func() error
+	}{
+		{"REDIS_POOL_SIZE", "abc", func() error { _, err := RedisOptionsFromEnv(); return err }},
+		{"REDIS_TLS", "maybe", func() error { _, err := RedisOptionsFromEnv(); return err }},
+		{"REDIS_DIAL_TIMEOUT", "2", func() error { _, err := NewRedisStorage(); return err }},
+		{"MEMORY_MAX_KEYS", "many", func() error { _, err := MemoryOptionsFromEnv(); return err }},
+		{"HYBRID_FLUSH_INTERVAL", "soon", func() error { _, err := HybridOptionsFromEnv(); return err }},
+		{"HYBRID_MAX_DELTA", "1.5", func() error { _, err := HybridOptionsFromEnv(); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+			if err := tt.read(); err == nil || !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("Expected an error naming %s, got %v", tt.key, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rate-limiter/limiter"
+)
+
+// DefaultRule is used when Options.Rule has no name.
+const DefaultRule = "outbound"
+
+type Options struct {
+	// Rule is the quota of each key, e.g. 100 requests per 60 seconds.
+	Rule limiter.Rule
+	// Key groups requests under one quota. Defaults to the request's host.
+	Key func(req *http.Request) string
+	// MaxWait is how long a request may wait for quota before failing with a
+	// *RateLimitError. Zero fails immediately.
+	MaxWait time.Duration
+}
+
+// RateLimitError is returned when a request cannot be sent within
+// Options.MaxWait.
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("outbound rate limit exceeded for %s, retry after %v", e.Key, e.RetryAfter)
+}
+
+// Transport is an http.RoundTripper that throttles outbound requests per key
+// with a limiter.RateLimiter.
+//
+// It also follows the upstream's signals: a Retry-After on a 429 or 503, or a
+// RateLimit-Remaining (or X-RateLimit-Remaining) of 0 with its reset, pause
+// the key until then, and a RateLimit-Limit lower than the rule's lowers the
+// local limit of the key. Pauses are also stored as blocks, so instances
+// sharing the storage respect them.
+type Transport struct {
+	base        http.RoundTripper
+	rateLimiter *limiter.RateLimiter
+	opts        Options
+	now         func() time.Time
+
+	mutex     sync.Mutex
+	upstreams map[string]*upstream
+}
+
+// upstream is what a key's responses said about its quota.
+type upstream struct {
+	limit int
+	until time.Time
+}
+
+// NewTransport wraps base, or http.DefaultTransport when base is nil.
+func NewTransport(base http.RoundTripper, rateLimiter *limiter.RateLimiter, opts Options) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if opts.Rule.Name == "" {
+		opts.Rule.Name = DefaultRule
+	}
+	if opts.Key == nil {
+		opts.Key = func(req *http.Request) string { return req.URL.Host }
+	}
+
+	return &Transport{
+		base:        base,
+		rateLimiter: rateLimiter,
+		opts:        opts,
+		now:         time.Now,
+		upstreams:   make(map[string]*upstream),
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	key := t.opts.Key(req)
+
+	if err := t.wait(ctx, key); err != nil {
+		// RoundTrip must close the body even when the request is not sent.
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.observe(ctx, key, resp)
+	return resp, nil
+}
+
+// wait blocks until a request for key may be sent, for up to MaxWait.
+func (t *Transport) wait(ctx context.Context, key string) error {
+	deadline := t.now().Add(t.opts.MaxWait)
+
+	for {
+		wait, err := t.reserve(ctx, key)
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+		if t.now().Add(wait).After(deadline) {
+			return &RateLimitError{Key: key, RetryAfter: wait}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve counts a request for key, returning how long to wait when the key
+// has no quota left.
+func (t *Transport) reserve(ctx context.Context, key string) (time.Duration, error) {
+	rule := t.opts.Rule
+
+	t.mutex.Lock()
+	if u, exists := t.upstreams[key]; exists {
+		if wait := u.until.Sub(t.now()); wait > 0 {
+			t.mutex.Unlock()
+			return wait, nil
+		}
+		if u.limit > 0 && u.limit < rule.Limit {
+			rule.Limit = u.limit
+		}
+	}
+	t.mutex.Unlock()
+
+	decision, err := t.rateLimiter.Allow(ctx, rule, key)
+	if err != nil {
+		return 0, err
+	}
+	if !decision.Limited {
+		return 0, nil
+	}
+	return time.Duration(decision.RetryAfter) * time.Second, nil
+}
+
+// observe adapts the quota of key to the upstream's response headers.
+func (t *Transport) observe(ctx context.Context, key string, resp *http.Response) {
+	limit, _ := headerInt(resp.Header, "RateLimit-Limit", "X-RateLimit-Limit")
+
+	var pause time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		pause = t.retryAfter(resp.Header.Get("Retry-After"))
+	}
+	if remaining, ok := headerInt(resp.Header, "RateLimit-Remaining", "X-RateLimit-Remaining"); ok && remaining == 0 && pause == 0 {
+		if reset, ok := headerInt(resp.Header, "RateLimit-Reset", "X-RateLimit-Reset"); ok {
+			pause = t.reset(reset)
+		}
+	}
+
+	if limit <= 0 && pause <= 0 {
+		return
+	}
+
+	// Blocks last whole seconds; pausing as long keeps both in step.
+	seconds := int(math.Ceil(pause.Seconds()))
+	pause = time.Duration(seconds) * time.Second
+
+	t.mutex.Lock()
+	u, exists := t.upstreams[key]
+	if !exists {
+		u = &upstream{}
+		t.upstreams[key] = u
+	}
+	if limit > 0 {
+		u.limit = limit
+	}
+	if pause > 0 {
+		u.until = t.now().Add(pause)
+	}
+	t.mutex.Unlock()
+
+	if pause > 0 {
+		// The pause already applies locally; sharing it is best effort and
+		// must not fail a response that was received.
+		t.rateLimiter.Block(ctx, t.opts.Rule, key, seconds)
+	}
+}
+
+// retryAfter parses a Retry-After in seconds or as an HTTP date.
+func (t *Transport) retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(t.now())
+	}
+	return 0
+}
+
+// reset reads a RateLimit-Reset, which is a number of seconds or, as sent by
+// some APIs in X-RateLimit-Reset, a Unix timestamp.
+func (t *Transport) reset(value int) time.Duration {
+	if value > 1000000000 {
+		return time.Unix(int64(value), 0).Sub(t.now())
+	}
+	return time.Duration(value) * time.Second
+}
+
+// headerInt reads the leading integer of the first header present, so
+// structured values like "100, 100;w=60" read as 100.
+func headerInt(header http.Header, names ...string) (int, bool) {
+	for _, name := range names {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		end := strings.IndexAny(value, ",;")
+		if end >= 0 {
+			value = value[:end]
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		return n, err == nil
+	}
+	return 0, false
+}
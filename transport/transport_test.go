@@ -0,0 +1,238 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/limiter"
+	"rate-limiter/storage"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func response(status int, headers map[string]string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	for name, value := range headers {
+		resp.Header.Set(name, value)
+	}
+	return resp
+}
+
+func newTestLimiter(t *testing.T) *limiter.RateLimiter {
+	memoryStorage := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { memoryStorage.Close() })
+	return limiter.NewRateLimiter(memoryStorage, &limiter.Config{})
+}
+
+func get(t *testing.T, transport http.RoundTripper, url string) (*http.Response, error) {
+	req, _ := http.NewRequest("GET", url, nil)
+	return transport.RoundTrip(req)
+}
+
+func TestTransport_LimitsPerHost(t *testing.T) {
+	calls := 0
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return response(http.StatusOK, nil), nil
+	})
+	transport := NewTransport(base, newTestLimiter(t), Options{
+		Rule: limiter.Rule{Limit: 2, BlockDuration: 60},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := get(t, transport, "https://api.example.com/items"); err != nil {
+			t.Errorf("Request %d should be sent, got %v", i+1, err)
+		}
+	}
+
+	_, err := get(t, transport, "https://api.example.com/items")
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("Expected RateLimitError, got %v", err)
+	}
+	if rateLimitErr.Key != "api.example.com" || rateLimitErr.RetryAfter != time.Minute {
+		t.Errorf("Unexpected error: %+v", rateLimitErr)
+	}
+	if calls != 2 {
+		t.Errorf("Rejected requests should not be sent, got %d calls", calls)
+	}
+
+	if _, err := get(t, transport, "https://other.example.com/items"); err != nil {
+		t.Errorf("Other hosts should not be limited, got %v", err)
+	}
+}
+
+func TestTransport_RetryAfter(t *testing.T) {
+	calls := 0
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return response(http.StatusTooManyRequests, map[string]string{"Retry-After": "1"}), nil
+		}
+		return response(http.StatusOK, nil), nil
+	})
+	rateLimiter := newTestLimiter(t)
+	rule := limiter.Rule{Limit: 100, BlockDuration: 60}
+	transport := NewTransport(base, rateLimiter, Options{Rule: rule})
+
+	resp, err := get(t, transport, "https://api.example.com/items")
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Upstream response should be returned, got %v, %v", resp, err)
+	}
+
+	_, err = get(t, transport, "https://api.example.com/items")
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.RetryAfter > time.Second {
+		t.Errorf("Expected to be paused for up to 1s, got %v", err)
+	}
+
+	// Instances sharing the storage see the pause too.
+	other := NewTransport(base, rateLimiter, Options{Rule: rule})
+	if _, err := get(t, other, "https://api.example.com/items"); !errors.As(err, &rateLimitErr) {
+		t.Errorf("Pause should be shared, got %v", err)
+	} else if rateLimitErr.RetryAfter <= 0 || rateLimitErr.RetryAfter > time.Second {
+		t.Errorf("Shared pause should last what is left of it, up to 1s, got %v", rateLimitErr.RetryAfter)
+	}
+
+	// Instances allowed to wait do so only until the shared pause ends.
+	patient := NewTransport(base, rateLimiter, Options{Rule: rule, MaxWait: 2 * time.Second})
+	start := time.Now()
+	if resp, err := get(t, patient, "https://api.example.com/items"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Request should be sent once the shared pause ends, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("Request should wait for the shared pause only, took %v", elapsed)
+	}
+
+	waiting := NewTransport(base, newTestLimiter(t), Options{Rule: rule, MaxWait: 2 * time.Second})
+	waiting.upstreams["api.example.com"] = &upstream{until: time.Now().Add(50 * time.Millisecond)}
+	start = time.Now()
+	resp, err = get(t, waiting, "https://api.example.com/items")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Request should be sent after waiting, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Request should wait for the pause, took %v", elapsed)
+	}
+}
+
+func TestTransport_RateLimitHeaders(t *testing.T) {
+	headers := map[string]string{"RateLimit-Limit": "1"}
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, headers), nil
+	})
+	transport := NewTransport(base, newTestLimiter(t), Options{
+		Rule: limiter.Rule{Limit: 10, BlockDuration: 60},
+	})
+
+	get(t, transport, "https://api.example.com/items")
+	if _, err := get(t, transport, "https://api.example.com/items"); err == nil {
+		t.Error("Lower upstream limit should apply")
+	}
+
+	headers = map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "30"}
+	get(t, transport, "https://other.example.com/items")
+	_, err := get(t, transport, "https://other.example.com/items")
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.RetryAfter < 29*time.Second || rateLimitErr.RetryAfter > 30*time.Second {
+		t.Errorf("Expected to be paused until the reset, got %v", err)
+	}
+}
+
+func TestTransport_ContextCancel(t *testing.T) {
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, nil), nil
+	})
+	transport := NewTransport(base, newTestLimiter(t), Options{
+		Rule:    limiter.Rule{Limit: 1, BlockDuration: 60},
+		MaxWait: time.Hour,
+	})
+	get(t, transport, "https://api.example.com/items")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.example.com/items", nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context error, got %v", err)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTransport_ClosesBodyWhenNotSent(t *testing.T) {
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, nil), nil
+	})
+	transport := NewTransport(base, newTestLimiter(t), Options{
+		Rule: limiter.Rule{Limit: 1, BlockDuration: 60},
+	})
+	get(t, transport, "https://api.example.com/items")
+
+	body := &closeRecorder{Reader: strings.NewReader("{}")}
+	req, _ := http.NewRequest("POST", "https://api.example.com/items", body)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("Expected the request to be limited")
+	}
+	if !body.closed {
+		t.Error("Expected the body of a limited request to be closed")
+	}
+
+	patient := NewTransport(base, newTestLimiter(t), Options{
+		Rule:    limiter.Rule{Limit: 1, BlockDuration: 60},
+		MaxWait: time.Hour,
+	})
+	get(t, patient, "https://api.example.com/items")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	body = &closeRecorder{Reader: strings.NewReader("{}")}
+	req, _ = http.NewRequestWithContext(ctx, "POST", "https://api.example.com/items", body)
+	if _, err := patient.RoundTrip(req); err == nil {
+		t.Fatal("Expected the context to end the wait")
+	}
+	if !body.closed {
+		t.Error("Expected the body of a cancelled request to be closed")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	transport := NewTransport(nil, nil, Options{})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	transport.now = func() time.Time { return now }
+
+	if d := transport.retryAfter("120"); d != 2*time.Minute {
+		t.Errorf("Expected 2m, got %v", d)
+	}
+	if d := transport.retryAfter("Mon, 01 Jan 2024 00:00:30 GMT"); d != 30*time.Second {
+		t.Errorf("Expected 30s, got %v", d)
+	}
+	if d := transport.reset(int(now.Add(time.Minute).Unix())); d != time.Minute {
+		t.Errorf("Expected 1m for a timestamp reset, got %v", d)
+	}
+
+	header := http.Header{"Ratelimit-Limit": {"100, 100;w=60"}}
+	if n, ok := headerInt(header, "RateLimit-Limit"); !ok || n != 100 {
+		t.Errorf("Expected 100, got %d", n)
+	}
+}